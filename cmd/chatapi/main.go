@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log/slog"
 	"os"
 	"os/signal"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/hastenr/chatapi/internal/config"
 	"github.com/hastenr/chatapi/internal/db"
+	"github.com/hastenr/chatapi/internal/pubsub"
 	"github.com/hastenr/chatapi/internal/services/delivery"
 	"github.com/hastenr/chatapi/internal/services/realtime"
 	"github.com/hastenr/chatapi/internal/services/tenant"
@@ -18,6 +20,10 @@ import (
 )
 
 func main() {
+	migrateOnly := flag.Bool("migrate", false, "apply pending migrations and exit")
+	rollbackSteps := flag.Int("rollback", 0, "roll back this many migrations and exit")
+	flag.Parse()
+
 	// Initialize structured logging
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelInfo,
@@ -31,38 +37,59 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Bus fans out row-level changes to in-process subscribers (the delivery
+	// worker's wake path, future WebSocket streaming) without polling.
+	bus := pubsub.NewBus()
+
 	// Initialize database
-	database, err := db.New(cfg.DatabaseDSN)
+	database, err := db.NewWithBus(cfg.DatabaseDSN, bus)
 	if err != nil {
 		slog.Error("Failed to initialize database", "error", err)
 		os.Exit(1)
 	}
 	defer database.Close()
 
+	if *rollbackSteps > 0 {
+		if err := db.Rollback(database, *rollbackSteps); err != nil {
+			slog.Error("Rollback failed", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Rollback complete", "steps", *rollbackSteps)
+		return
+	}
+
 	// Run migrations
 	if err := db.RunMigrations(database); err != nil {
 		slog.Error("Failed to run migrations", "error", err)
 		os.Exit(1)
 	}
 
+	if *migrateOnly {
+		slog.Info("Migrations applied, exiting (--migrate)")
+		return
+	}
+
 	// Initialize services
-	tenantSvc := tenant.NewService(database.DB)
+	tenantSvc := tenant.NewService(database.DB, cfg)
 	realtimeSvc := realtime.NewService(database.DB)
 	deliverySvc := delivery.NewService(database.DB, realtimeSvc)
 
 	// Initialize workers
-	deliveryWorker := worker.NewDeliveryWorker(database, deliverySvc, cfg.WorkerInterval)
+	deliveryWorker := worker.NewDeliveryWorker(database, deliverySvc, cfg.WorkerInterval, cfg.WorkerDebounce, cfg.WorkerConcurrency)
 	walWorker := worker.NewWALCheckpointWorker(database, 5*time.Minute)
+	rateLimitGCWorker := worker.NewRateLimitGCWorker(tenantSvc, cfg.RateLimitGCInterval, cfg.RateLimitIdleTTL)
 
 	// Start background workers
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	deliveryWorker.SubscribeBus(ctx, bus)
 	deliveryWorker.Start(ctx)
 	walWorker.Start(ctx)
+	rateLimitGCWorker.Start(ctx)
 
 	// Initialize HTTP server
-	server := transport.NewServer(cfg, database, tenantSvc, realtimeSvc, deliverySvc)
+	server := transport.NewServer(cfg, database, tenantSvc, realtimeSvc, deliverySvc, deliveryWorker, bus)
 
 	// Handle graceful shutdown
 	shutdown := make(chan os.Signal, 1)
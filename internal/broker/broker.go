@@ -0,0 +1,30 @@
+// Package broker defines a pluggable pub/sub transport for fanning events
+// out across chatapi nodes, so a cluster can run behind a load balancer with
+// sticky-less WebSocket routing: whichever node a client lands on, it still
+// receives messages and presence updates originated on any other node.
+//
+// Subjects follow a dotted NATS-style hierarchy - "chatapi.<tenantID>.room.
+// <roomID>" for chat messages and acks, "chatapi.<tenantID>.presence.
+// <userID>" for presence - so a subscriber can listen broadly with "*" and
+// ">" wildcards (see InProcess's doc comment for exactly what those mean)
+// instead of one subscription per room or user. NewInProcess is always
+// available; NewNATS (nats.go) and NewRedisStreams (redis.go) are each
+// gated behind their own build tag since both pull in a real network
+// dependency most builds don't need.
+package broker
+
+// Broker publishes byte payloads to a subject and lets subscribers listen
+// for them, across however many chatapi nodes share the same broker.
+// Publish must not block waiting for a subscriber; Subscribe's handler runs
+// on its own goroutine per delivery.
+type Broker interface {
+	// Publish sends payload to every current subscriber whose pattern
+	// matches subject, on this node and (for a networked implementation)
+	// every other node sharing the same broker.
+	Publish(subject string, payload []byte) error
+
+	// Subscribe registers handler to be called with the payload of every
+	// future Publish whose subject matches pattern. Returns an unsubscribe
+	// func that stops delivery; it is safe to call more than once.
+	Subscribe(pattern string, handler func(payload []byte)) (unsubscribe func(), err error)
+}
@@ -0,0 +1,88 @@
+package broker
+
+import (
+	"strings"
+	"sync"
+)
+
+// InProcess is the default Broker: a single-process fanout with no external
+// dependency, matching chatapi's behavior before this package existed. It
+// implements the same subject-matching rules as NATS core pub/sub (see
+// subjectMatches) so that swapping in the NATS build (nats.go, behind the
+// "nats" build tag) changes nothing about which subscribers receive which
+// publishes.
+type InProcess struct {
+	mu   sync.RWMutex
+	subs map[*inprocessSub]struct{}
+}
+
+type inprocessSub struct {
+	pattern string
+	handler func(payload []byte)
+}
+
+// NewInProcess creates an empty InProcess broker.
+func NewInProcess() *InProcess {
+	return &InProcess{subs: make(map[*inprocessSub]struct{})}
+}
+
+// Publish delivers payload, on its own goroutine per subscriber, to every
+// subscription whose pattern matches subject.
+func (b *InProcess) Publish(subject string, payload []byte) error {
+	b.mu.RLock()
+	var matched []*inprocessSub
+	for sub := range b.subs {
+		if subjectMatches(sub.pattern, subject) {
+			matched = append(matched, sub)
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, sub := range matched {
+		go sub.handler(payload)
+	}
+	return nil
+}
+
+// Subscribe registers handler for pattern, which may use "*" to match
+// exactly one dot-separated token and ">" to match one or more trailing
+// tokens (e.g. "chatapi.*.room.>").
+func (b *InProcess) Subscribe(pattern string, handler func(payload []byte)) (func(), error) {
+	sub := &inprocessSub{pattern: pattern, handler: handler}
+
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, sub)
+			b.mu.Unlock()
+		})
+	}
+	return unsubscribe, nil
+}
+
+// subjectMatches reports whether subject satisfies pattern under NATS
+// subject-matching rules: "*" matches exactly one token, ">" matches the
+// rest of the subject and must be the final token, anything else must match
+// literally.
+func subjectMatches(pattern, subject string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	subjectTokens := strings.Split(subject, ".")
+
+	for i, pt := range patternTokens {
+		if pt == ">" {
+			return i < len(subjectTokens)
+		}
+		if i >= len(subjectTokens) {
+			return false
+		}
+		if pt != "*" && pt != subjectTokens[i] {
+			return false
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}
@@ -0,0 +1,69 @@
+//go:build nats
+
+package broker
+
+import (
+	"log/slog"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATS is the cross-node Broker, compiled in only with `go build -tags nats`
+// since it pulls in a real network dependency (a running NATS server) that
+// most deployments - a single node, CI, local dev - don't have. Build
+// without the tag and NewInProcess is the only Broker available; this file
+// doesn't exist in that build at all.
+type NATS struct {
+	conn *nats.Conn
+}
+
+// NewNATS connects to the NATS server at url (e.g. "nats://localhost:4222").
+// Reconnection is handled by the nats.go client itself - it buffers
+// publishes and transparently resubscribes every active Subscribe() across
+// a dropped connection - these options just make that behavior unbounded
+// (the default reconnect attempt count gives up eventually) and observable
+// via slog instead of silent.
+func NewNATS(url string) (*NATS, error) {
+	conn, err := nats.Connect(url,
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				slog.Warn("NATS broker disconnected, reconnecting", "error", err)
+			}
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			slog.Info("NATS broker reconnected", "url", c.ConnectedUrl())
+		}),
+		nats.ClosedHandler(func(*nats.Conn) {
+			slog.Error("NATS broker connection closed permanently")
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &NATS{conn: conn}, nil
+}
+
+// Publish sends payload on subject via the underlying NATS connection.
+func (n *NATS) Publish(subject string, payload []byte) error {
+	return n.conn.Publish(subject, payload)
+}
+
+// Subscribe registers handler for pattern using NATS' own "*"/">" wildcard
+// subject matching, which subjectMatches (see inprocess.go) mirrors.
+func (n *NATS) Subscribe(pattern string, handler func(payload []byte)) (func(), error) {
+	sub, err := n.conn.Subscribe(pattern, func(msg *nats.Msg) {
+		go handler(msg.Data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() { _ = sub.Unsubscribe() }, nil
+}
+
+// Close closes the underlying NATS connection; it does not drain pending
+// subscriptions first.
+func (n *NATS) Close() error {
+	n.conn.Close()
+	return nil
+}
@@ -0,0 +1,178 @@
+//go:build redis
+
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisStreamKey is the single Redis stream every subject is published to;
+// subscribers filter by pattern client-side (see subjectMatches) instead of
+// Redis routing per-subject, since streams have no subject wildcarding of
+// their own. One shared stream keeps delivery ordered across every
+// tenant/room instead of fragmenting into one stream per room.
+const redisStreamKey = "chatapi:events"
+
+// redisReconnectMinBackoff/MaxBackoff bound consumeLoop's reconnect delay
+// after an XRead error, doubling each consecutive failure and resetting on
+// the next successful read.
+const (
+	redisReconnectMinBackoff = 500 * time.Millisecond
+	redisReconnectMaxBackoff = 30 * time.Second
+)
+
+// RedisStreams is the cross-node Broker backed by a Redis Stream, compiled
+// in only with `go build -tags redis` (see NATS' doc comment in nats.go for
+// why this package gates real network dependencies behind build tags).
+// Unlike NATS core pub/sub, an entry written while this broker is briefly
+// cut off from Redis isn't simply dropped: after a failed XRead,
+// consumeLoop resumes from the last entry ID it saw. Its first XRead,
+// though, starts at the tail ("$"), so entries published before that (e.g.
+// while this node was restarting) are never delivered to it - there is no
+// historical replay.
+type RedisStreams struct {
+	client *redis.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu   sync.RWMutex
+	subs map[*redisSub]struct{}
+}
+
+type redisSub struct {
+	pattern string
+	handler func(payload []byte)
+}
+
+// NewRedisStreams connects to the Redis server at addr and starts consuming
+// redisStreamKey in the background.
+func NewRedisStreams(addr string) (*RedisStreams, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := client.Ping(ctx).Err(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("connect to redis: %w", err)
+	}
+
+	r := &RedisStreams{client: client, ctx: ctx, cancel: cancel, subs: make(map[*redisSub]struct{})}
+	go r.consumeLoop()
+	return r, nil
+}
+
+// Publish appends payload to redisStreamKey with subject as a field, for
+// every node's consumeLoop (including this one) to pick up and dispatch to
+// its local subscribers whose pattern matches.
+func (r *RedisStreams) Publish(subject string, payload []byte) error {
+	return r.client.XAdd(r.ctx, &redis.XAddArgs{
+		Stream: redisStreamKey,
+		Values: map[string]interface{}{
+			"subject": subject,
+			"payload": payload,
+		},
+	}).Err()
+}
+
+// Subscribe registers handler for pattern, using the same "*"/">" wildcard
+// rules as InProcess and NATS (see subjectMatches).
+func (r *RedisStreams) Subscribe(pattern string, handler func(payload []byte)) (func(), error) {
+	sub := &redisSub{pattern: pattern, handler: handler}
+
+	r.mu.Lock()
+	r.subs[sub] = struct{}{}
+	r.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			r.mu.Lock()
+			delete(r.subs, sub)
+			r.mu.Unlock()
+		})
+	}
+	return unsubscribe, nil
+}
+
+// Close stops the consumer loop and closes the underlying Redis client.
+func (r *RedisStreams) Close() error {
+	r.cancel()
+	return r.client.Close()
+}
+
+// consumeLoop blocks on XRead from the tail of redisStreamKey and dispatches
+// every entry to matching local subscribers. Redis Streams have no
+// client-side resubscribe step the way NATS does - lastID alone determines
+// where the next XRead resumes - so reconnecting after a dropped connection
+// is just a matter of retrying XRead with backoff until the server is
+// reachable again.
+func (r *RedisStreams) consumeLoop() {
+	lastID := "$"
+	backoff := redisReconnectMinBackoff
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		default:
+		}
+
+		streams, err := r.client.XRead(r.ctx, &redis.XReadArgs{
+			Streams: []string{redisStreamKey, lastID},
+			Block:   0,
+		}).Result()
+		if err != nil {
+			if r.ctx.Err() != nil {
+				return
+			}
+			slog.Warn("Redis Streams broker lost connection, reconnecting", "error", err, "backoff", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-r.ctx.Done():
+				return
+			}
+			if backoff < redisReconnectMaxBackoff {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = redisReconnectMinBackoff
+
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				lastID = msg.ID
+				r.dispatch(msg.Values)
+			}
+		}
+	}
+}
+
+// dispatch delivers payload to every subscriber whose pattern matches
+// subject, on its own goroutine per subscriber, mirroring InProcess.Publish.
+func (r *RedisStreams) dispatch(values map[string]interface{}) {
+	subject, _ := values["subject"].(string)
+	if subject == "" {
+		return
+	}
+	payloadStr, _ := values["payload"].(string)
+	payload := []byte(payloadStr)
+
+	r.mu.RLock()
+	var matched []*redisSub
+	for sub := range r.subs {
+		if subjectMatches(sub.pattern, subject) {
+			matched = append(matched, sub)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, sub := range matched {
+		go sub.handler(payload)
+	}
+}
@@ -1,36 +1,87 @@
 package config
 
 import (
+	"log/slog"
+	"net/netip"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Config holds all configuration for the ChatAPI service
 type Config struct {
 	// Server configuration
-	ListenAddr           string
-	DataDir              string
+	ListenAddr string
+	DataDir    string
+	NodeID     string
 
 	// Database configuration
-	DatabaseDSN          string
+	DatabaseDSN string
 
 	// Worker configuration
-	WorkerInterval       time.Duration
-	RetryMaxAttempts     int
-	RetryInterval        time.Duration
+	WorkerInterval    time.Duration
+	WorkerDebounce    time.Duration
+	WorkerConcurrency int
+	RetryMaxAttempts  int
+	RetryInterval     time.Duration
+	RetryMaxBackoff   time.Duration
+	RetryJitter       float64
+	WebhookWorkers    int
 
 	// Shutdown configuration
 	ShutdownDrainTimeout time.Duration
 
 	// Logging
-	LogLevel             string
+	LogLevel string
+	LogDir   string
 
 	// Rate limiting defaults
-	DefaultRateLimit     int // requests per second per tenant
+	DefaultRateLimit int // requests per second per tenant
+
+	// Per-route rate limiting (Discord-style layered buckets: route, then
+	// tenant, then process-wide)
+	RateLimitMessagesCapacity float64
+	RateLimitMessagesRefill   float64
+	RateLimitNotifyCapacity   float64
+	RateLimitNotifyRefill     float64
+	RateLimitWSCapacity       float64
+	RateLimitWSRefill         float64
+	RateLimitDefaultCapacity  float64
+	RateLimitDefaultRefill    float64
+	RateLimitTenantCapacity   float64
+	RateLimitTenantRefill     float64
+	RateLimitGlobalCapacity   float64
+	RateLimitGlobalRefill     float64
+	// RateLimitIPCapacity/Refill size the optional per-(tenant, client IP)
+	// bucket (see ratelimit.Limiter.CheckWithIPLimit) that sits alongside the
+	// tenant-wide bucket, so a single abusive IP can be throttled without
+	// starving the rest of its tenant's traffic.
+	RateLimitIPCapacity float64
+	RateLimitIPRefill   float64
+	RateLimitGCInterval time.Duration
+	RateLimitIdleTTL    time.Duration
+
+	// TrustedProxies lists the CIDRs of reverse proxies allowed to set
+	// X-Real-IP/X-Forwarded-For (see netutil.ClientIP); hops outside this
+	// list are never skipped when walking X-Forwarded-For, so a spoofed
+	// header can't impersonate a trusted hop.
+	TrustedProxies []netip.Prefix
+
+	// WebSocket session resume (Discord gateway-style disconnect/resume)
+	WSSessionTTL           time.Duration
+	WSSessionGCInterval    time.Duration
+	WSResumeMaxReplay      int // per room; exceeding this on resume means the gap is out of window
+	WSCompressionThreshold int // bytes; below this, the msgpack-br subprotocol sends uncompressed
 
 	// Admin configuration
-	MasterAPIKey         string
+	MasterAPIKey string
+
+	// Federation identifies this deployment to federation peers (see
+	// internal/federation) and bounds how many peer relays run concurrently
+	// per ProcessPending batch.
+	FederationServerName string
+	FederationWorkers    int
 }
 
 // Load loads configuration from environment variables with sensible defaults
@@ -38,6 +89,7 @@ func Load() (*Config, error) {
 	cfg := &Config{
 		ListenAddr:           getEnv("LISTEN_ADDR", ":8080"),
 		DataDir:              getEnv("DATA_DIR", "/var/chatapi"),
+		NodeID:               getEnv("NODE_ID", defaultNodeID()),
 		LogDir:               getEnv("LOG_DIR", "/var/log/chatapi"),
 		DatabaseDSN:          getEnv("DATABASE_DSN", "file:chatapi.db?_journal_mode=WAL&_busy_timeout=5000"),
 		LogLevel:             getEnv("LOG_LEVEL", "info"),
@@ -45,13 +97,56 @@ func Load() (*Config, error) {
 		RetryMaxAttempts:     getEnvAsInt("RETRY_MAX_ATTEMPTS", 5),
 		ShutdownDrainTimeout: getEnvAsDuration("SHUTDOWN_DRAIN_TIMEOUT", 10*time.Second),
 		WorkerInterval:       getEnvAsDuration("WORKER_INTERVAL", 30*time.Second),
+		WorkerDebounce:       getEnvAsDuration("WORKER_DEBOUNCE", 50*time.Millisecond),
+		WorkerConcurrency:    getEnvAsInt("WORKER_CONCURRENCY", 4),
 		RetryInterval:        getEnvAsDuration("RETRY_INTERVAL", 30*time.Second),
-		MasterAPIKey:         getEnv("MASTER_API_KEY", ""),
+		RetryMaxBackoff:      getEnvAsDuration("RETRY_MAX_BACKOFF", 1*time.Hour),
+		RetryJitter:          getEnvAsFloat("RETRY_JITTER", 0.2),
+		WebhookWorkers:       getEnvAsInt("WEBHOOK_WORKERS", 4),
+
+		RateLimitMessagesCapacity: getEnvAsFloat("RATE_LIMIT_MESSAGES_CAPACITY", 10),
+		RateLimitMessagesRefill:   getEnvAsFloat("RATE_LIMIT_MESSAGES_REFILL", 5),
+		RateLimitNotifyCapacity:   getEnvAsFloat("RATE_LIMIT_NOTIFY_CAPACITY", 5),
+		RateLimitNotifyRefill:     getEnvAsFloat("RATE_LIMIT_NOTIFY_REFILL", 2),
+		RateLimitWSCapacity:       getEnvAsFloat("RATE_LIMIT_WS_CAPACITY", 20),
+		RateLimitWSRefill:         getEnvAsFloat("RATE_LIMIT_WS_REFILL", 10),
+		RateLimitDefaultCapacity:  getEnvAsFloat("RATE_LIMIT_DEFAULT_CAPACITY", 20),
+		RateLimitDefaultRefill:    getEnvAsFloat("RATE_LIMIT_DEFAULT_REFILL", 10),
+		RateLimitTenantCapacity:   getEnvAsFloat("RATE_LIMIT_TENANT_CAPACITY", 50),
+		RateLimitTenantRefill:     getEnvAsFloat("RATE_LIMIT_TENANT_REFILL", 25),
+		RateLimitGlobalCapacity:   getEnvAsFloat("RATE_LIMIT_GLOBAL_CAPACITY", 2000),
+		RateLimitGlobalRefill:     getEnvAsFloat("RATE_LIMIT_GLOBAL_REFILL", 1000),
+		RateLimitIPCapacity:       getEnvAsFloat("RATE_LIMIT_IP_CAPACITY", 5),
+		RateLimitIPRefill:         getEnvAsFloat("RATE_LIMIT_IP_REFILL", 2),
+		RateLimitGCInterval:       getEnvAsDuration("RATE_LIMIT_GC_INTERVAL", 5*time.Minute),
+		RateLimitIdleTTL:          getEnvAsDuration("RATE_LIMIT_IDLE_TTL", 15*time.Minute),
+
+		TrustedProxies: getEnvAsCIDRList("CHATAPI_TRUSTED_PROXIES"),
+
+		WSSessionTTL:           getEnvAsDuration("WS_SESSION_TTL", 5*time.Minute),
+		WSSessionGCInterval:    getEnvAsDuration("WS_SESSION_GC_INTERVAL", 1*time.Minute),
+		WSResumeMaxReplay:      getEnvAsInt("WS_RESUME_MAX_REPLAY", 200),
+		WSCompressionThreshold: getEnvAsInt("WS_COMPRESSION_THRESHOLD", 256),
+
+		MasterAPIKey: getEnv("MASTER_API_KEY", ""),
+
+		FederationServerName: getEnv("FEDERATION_SERVER_NAME", defaultNodeID()),
+		FederationWorkers:    getEnvAsInt("FEDERATION_WORKERS", 4),
 	}
 
 	return cfg, nil
 }
 
+// defaultNodeID returns the host's name for use as this instance's realtime
+// backplane node ID when NODE_ID isn't set, falling back to a fixed label if
+// the hostname can't be determined (e.g. in some sandboxed environments).
+func defaultNodeID() string {
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return "node-unknown"
+}
+
 // getEnv gets an environment variable or returns a default value
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -70,6 +165,42 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getEnvAsFloat gets an environment variable as float64 or returns a default value
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
+// getEnvAsCIDRList parses a comma-separated list of CIDRs (e.g.
+// CHATAPI_TRUSTED_PROXIES) into netip.Prefix values. An entry that fails to
+// parse is logged and skipped rather than failing startup, so one typo
+// doesn't take down the whole list.
+func getEnvAsCIDRList(key string) []netip.Prefix {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			slog.Warn("Ignoring invalid entry in trusted proxies list", "env", key, "value", entry, "error", err)
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
 // getEnvAsDuration gets an environment variable as time.Duration or returns a default value
 func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
 	if value := os.Getenv(key); value != "" {
@@ -78,4 +209,4 @@ func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
 		}
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
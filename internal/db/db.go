@@ -7,6 +7,8 @@ import (
 	"log/slog"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/hastenr/chatapi/internal/pubsub"
 )
 
 //go:embed migrations/*.sql
@@ -19,7 +21,18 @@ type DB struct {
 
 // New creates a new database connection
 func New(dsn string) (*DB, error) {
-	db, err := sql.Open("sqlite3", dsn)
+	return newWithDriver(dsn, "sqlite3")
+}
+
+// NewWithBus creates a new database connection whose driver forwards every
+// row-level INSERT/UPDATE/DELETE to bus via SQLite's update hook, so
+// subscribers can react without polling.
+func NewWithBus(dsn string, bus *pubsub.Bus) (*DB, error) {
+	return newWithDriver(dsn, pubsub.RegisterSQLiteDriver(bus))
+}
+
+func newWithDriver(dsn, driverName string) (*DB, error) {
+	db, err := sql.Open(driverName, dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -37,7 +50,9 @@ func New(dsn string) (*DB, error) {
 	return &DB{db}, nil
 }
 
-// RunMigrations runs all database migrations
+// RunMigrations brings the schema up to date by applying every pending
+// migration, in version order. See Migrate for the underlying mechanics,
+// including transactional guarantees and checksum verification.
 func RunMigrations(db *DB) error {
 	slog.Info("Running database migrations")
 
@@ -56,76 +71,11 @@ func RunMigrations(db *DB) error {
 		return fmt.Errorf("failed to set WAL autocheckpoint: %w", err)
 	}
 
-	// Create migrations table if it doesn't exist
-	if err := createMigrationsTable(db); err != nil {
-		return fmt.Errorf("failed to create migrations table: %w", err)
-	}
-
-	// Get list of migration files
-	entries, err := migrationsFS.ReadDir("migrations")
-	if err != nil {
-		return fmt.Errorf("failed to read migrations directory: %w", err)
-	}
-
-	// Run migrations in order
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-
-		filename := entry.Name()
-		if err := runMigration(db, filename); err != nil {
-			return fmt.Errorf("failed to run migration %s: %w", filename, err)
-		}
-	}
-
-	slog.Info("Database migrations completed successfully")
-	return nil
-}
-
-// createMigrationsTable creates the schema_migrations table
-func createMigrationsTable(db *DB) error {
-	query := `
-		CREATE TABLE IF NOT EXISTS schema_migrations (
-			version TEXT PRIMARY KEY,
-			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)
-	`
-	_, err := db.Exec(query)
-	return err
-}
-
-// runMigration runs a single migration if it hasn't been applied yet
-func runMigration(db *DB, filename string) error {
-	// Check if migration has already been applied
-	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = ?", filename).Scan(&count)
-	if err != nil {
+	if err := Migrate(db, -1); err != nil {
 		return err
 	}
 
-	if count > 0 {
-		slog.Debug("Migration already applied", "file", filename)
-		return nil
-	}
-
-	// Read migration file
-	content, err := migrationsFS.ReadFile("migrations/" + filename)
-	if err != nil {
-		return fmt.Errorf("failed to read migration file: %w", err)
-	}
-
-	// Execute migration
-	slog.Info("Applying migration", "file", filename)
-	if _, err := db.Exec(string(content)); err != nil {
-		return fmt.Errorf("failed to execute migration: %w", err)
-	}
-
-	// Record migration as applied
-	if _, err := db.Exec("INSERT INTO schema_migrations (version) VALUES (?)", filename); err != nil {
-		return fmt.Errorf("failed to record migration: %w", err)
-	}
-
+	slog.Info("Database migrations completed successfully")
 	return nil
 }
 
@@ -141,4 +91,4 @@ func CheckpointWAL(db *DB) error {
 // Close closes the database connection
 func (db *DB) Close() error {
 	return db.DB.Close()
-}
\ No newline at end of file
+}
@@ -0,0 +1,318 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// noTransactionMarker opts a migration file out of being wrapped in a
+// transaction, for statements SQLite refuses to run inside one (e.g. some
+// PRAGMA changes).
+const noTransactionMarker = "-- +migrate NoTransaction"
+
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Migration is a single versioned schema change, assembled from a matching
+// NNNN_name.up.sql / NNNN_name.down.sql pair. DownSQL is empty if no down
+// file was provided, which makes the migration irreversible.
+type Migration struct {
+	Version int
+	Name    string
+	UpSQL   string
+	DownSQL string
+}
+
+// Hook runs arbitrary Go code immediately before or after a specific
+// migration version is applied, so features like the pubsub bus or WAL
+// tuning can react to a schema change without the migrator knowing about
+// them.
+type Hook func(db *DB) error
+
+var (
+	preHooks  = make(map[int][]Hook)
+	postHooks = make(map[int][]Hook)
+)
+
+// RegisterPreHook runs fn immediately before migration version is applied.
+func RegisterPreHook(version int, fn Hook) {
+	preHooks[version] = append(preHooks[version], fn)
+}
+
+// RegisterPostHook runs fn immediately after migration version is applied.
+func RegisterPostHook(version int, fn Hook) {
+	postHooks[version] = append(postHooks[version], fn)
+}
+
+// loadMigrations parses every NNNN_name.up.sql / NNNN_name.down.sql pair
+// embedded under migrations/, sorted by version.
+func loadMigrations() ([]Migration, error) {
+	entries, err := migrationsFS.ReadDir("migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations directory: %w", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration file %q does not match NNNN_name.(up|down).sql", entry.Name())
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %q: %w", entry.Name(), err)
+		}
+
+		content, err := migrationsFS.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration file %s: %w", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+
+		switch match[3] {
+		case "up":
+			m.UpSQL = string(content)
+		case "down":
+			m.DownSQL = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.UpSQL == "" {
+			return nil, fmt.Errorf("migration %04d_%s has a down file but no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func checksum(sql string) string {
+	sum := sha256.Sum256([]byte(sql))
+	return hex.EncodeToString(sum[:])
+}
+
+// createSchemaMigrationsTable creates the migration tracking table if it
+// doesn't already exist.
+func createSchemaMigrationsTable(db *DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT NOT NULL,
+			checksum   TEXT NOT NULL,
+			applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+type appliedMigration struct {
+	Version  int
+	Checksum string
+}
+
+func loadAppliedMigrations(db *DB) (map[int]appliedMigration, error) {
+	rows, err := db.Query(`SELECT version, checksum FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.Version, &a.Checksum); err != nil {
+			return nil, err
+		}
+		applied[a.Version] = a
+	}
+	return applied, rows.Err()
+}
+
+// Migrate applies every pending up-migration up to and including
+// targetVersion, in order, or every pending migration if targetVersion is
+// negative. Each migration runs in its own transaction unless its up file
+// contains noTransactionMarker. It refuses to proceed if an already-applied
+// migration's file has changed since it was applied, since that usually
+// means dev and prod have drifted.
+func Migrate(db *DB, targetVersion int) error {
+	if err := createSchemaMigrationsTable(db); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	applied, err := loadAppliedMigrations(db)
+	if err != nil {
+		return fmt.Errorf("failed to load applied migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		sum := checksum(m.UpSQL)
+
+		if a, ok := applied[m.Version]; ok {
+			if a.Checksum != sum {
+				return fmt.Errorf("migration %04d_%s was modified after being applied (checksum mismatch)", m.Version, m.Name)
+			}
+			continue
+		}
+
+		if targetVersion >= 0 && m.Version > targetVersion {
+			break
+		}
+
+		for _, hook := range preHooks[m.Version] {
+			if err := hook(db); err != nil {
+				return fmt.Errorf("pre-hook for migration %04d failed: %w", m.Version, err)
+			}
+		}
+
+		if err := applyUp(db, m, sum); err != nil {
+			return err
+		}
+		slog.Info("Applied migration", "version", m.Version, "name", m.Name)
+
+		for _, hook := range postHooks[m.Version] {
+			if err := hook(db); err != nil {
+				return fmt.Errorf("post-hook for migration %04d failed: %w", m.Version, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func applyUp(db *DB, m Migration, sum string) error {
+	record := func(exec func(query string, args ...interface{}) error) error {
+		if err := exec(m.UpSQL); err != nil {
+			return fmt.Errorf("failed to execute migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if err := exec(`INSERT INTO schema_migrations (version, name, checksum) VALUES (?, ?, ?)`, m.Version, m.Name, sum); err != nil {
+			return fmt.Errorf("failed to record migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		return nil
+	}
+
+	if strings.Contains(m.UpSQL, noTransactionMarker) {
+		return record(func(query string, args ...interface{}) error {
+			_, err := db.Exec(query, args...)
+			return err
+		})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for migration %04d_%s: %w", m.Version, m.Name, err)
+	}
+	defer tx.Rollback()
+
+	if err := record(func(query string, args ...interface{}) error {
+		_, err := tx.Exec(query, args...)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Rollback undoes the most recently applied steps migrations, in reverse
+// order, using their down SQL. It fails if any migration being undone has no
+// down file.
+func Rollback(db *DB, steps int) error {
+	if steps <= 0 {
+		return fmt.Errorf("steps must be positive")
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	byVersion := make(map[int]Migration, len(migrations))
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+
+	applied, err := loadAppliedMigrations(db)
+	if err != nil {
+		return fmt.Errorf("failed to load applied migrations: %w", err)
+	}
+
+	versions := make([]int, 0, len(applied))
+	for v := range applied {
+		versions = append(versions, v)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	if steps > len(versions) {
+		steps = len(versions)
+	}
+
+	for _, version := range versions[:steps] {
+		m, ok := byVersion[version]
+		if !ok || m.DownSQL == "" {
+			return fmt.Errorf("migration %04d has no down file, cannot roll back", version)
+		}
+
+		if err := applyDown(db, m); err != nil {
+			return err
+		}
+		slog.Info("Rolled back migration", "version", m.Version, "name", m.Name)
+	}
+
+	return nil
+}
+
+func applyDown(db *DB, m Migration) error {
+	run := func(exec func(query string, args ...interface{}) error) error {
+		if err := exec(m.DownSQL); err != nil {
+			return fmt.Errorf("failed to execute down migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if err := exec(`DELETE FROM schema_migrations WHERE version = ?`, m.Version); err != nil {
+			return fmt.Errorf("failed to unrecord migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		return nil
+	}
+
+	if strings.Contains(m.DownSQL, noTransactionMarker) {
+		return run(func(query string, args ...interface{}) error {
+			_, err := db.Exec(query, args...)
+			return err
+		})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for down migration %04d_%s: %w", m.Version, m.Name, err)
+	}
+	defer tx.Rollback()
+
+	if err := run(func(query string, args ...interface{}) error {
+		_, err := tx.Exec(query, args...)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,422 @@
+// Package federation lets a room hosted on this server include participants
+// on another ChatAPI deployment. A room is federated by registering one or
+// more peer servers against it (room_federation); new messages in that room
+// are then queued in federation_outbox and relayed, one request per peer, to
+// POST /_federation/send on the peer's base URL. Requests are authenticated
+// Matrix server-server style: signed with this server's Ed25519 key, and
+// verified by the peer against our previously-registered public key, rather
+// than a shared secret either side could leak.
+package federation
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hastenr/chatapi/internal/models"
+	"github.com/hastenr/chatapi/internal/retry"
+	"github.com/hastenr/chatapi/internal/services/message"
+)
+
+// defaultRetryPolicy is used until SetRetryPolicy is called with values from
+// config.Config.
+var defaultRetryPolicy = retry.Policy{
+	MaxAttempts:  5,
+	BaseInterval: 30 * time.Second,
+	MaxBackoff:   1 * time.Hour,
+	Jitter:       0.2,
+}
+
+// RemoteServer is one peer a room is federated with.
+type RemoteServer struct {
+	ServerName string
+	BaseURL    string
+}
+
+// Service relays messages to federation peers and authenticates inbound
+// relays from them. HTTP calls to peers are bounded by a worker pool so one
+// unreachable peer can't stall delivery to the rest.
+type Service struct {
+	db          *sql.DB
+	messageSvc  *message.Service
+	httpClient  *http.Client
+	retryPolicy retry.Policy
+	workers     int
+
+	serverName string
+	signingKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+// NewService creates a new federation service identifying itself to peers as
+// serverName, generating a fresh Ed25519 signing key. A production
+// deployment would persist and reload this key (e.g. from a secret store)
+// so a restart doesn't invalidate every peer's trust of our public key; no
+// such store exists in this codebase yet, so the key is regenerated, and
+// every peer must be re-registered with PublicKeyHex, on every restart.
+func NewService(db *sql.DB, messageSvc *message.Service, serverName string, workers int) *Service {
+	if workers <= 0 {
+		workers = 4
+	}
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic("failed to generate federation signing key: " + err.Error())
+	}
+
+	return &Service{
+		db:          db,
+		messageSvc:  messageSvc,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+		retryPolicy: defaultRetryPolicy,
+		workers:     workers,
+		serverName:  serverName,
+		signingKey:  priv,
+		publicKey:   pub,
+	}
+}
+
+// SetRetryPolicy overrides the exponential backoff policy used for outbound
+// federation retries.
+func (s *Service) SetRetryPolicy(p retry.Policy) {
+	s.retryPolicy = p
+}
+
+// PublicKeyHex returns this server's Ed25519 public key, hex-encoded, for an
+// operator to hand to peers out of band so they can RegisterPeer us.
+func (s *Service) PublicKeyHex() string {
+	return hex.EncodeToString(s.publicKey)
+}
+
+// RegisterPeer records (or updates) a federation peer's base URL and public
+// key, so SendMessageEvent can reach it and HandleIncomingSend can verify
+// requests it claims to send us.
+func (s *Service) RegisterPeer(serverName, baseURL, publicKeyHex string) error {
+	if _, err := hex.DecodeString(publicKeyHex); err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+
+	_, err := s.db.Exec(`
+		INSERT INTO federation_peers (server_name, base_url, public_key)
+		VALUES (?, ?, ?)
+		ON CONFLICT (server_name) DO UPDATE SET base_url = excluded.base_url, public_key = excluded.public_key
+	`, serverName, baseURL, publicKeyHex)
+	if err != nil {
+		return fmt.Errorf("failed to register federation peer: %w", err)
+	}
+	return nil
+}
+
+// IncludeRoom federates tenantID's roomID with peerServerName, which must
+// already be registered via RegisterPeer. Subsequent SendMessageEvent calls
+// for this room relay to it.
+func (s *Service) IncludeRoom(tenantID, roomID, peerServerName string) error {
+	var exists int
+	if err := s.db.QueryRow(`SELECT 1 FROM federation_peers WHERE server_name = ?`, peerServerName).Scan(&exists); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("unknown federation peer %q", peerServerName)
+		}
+		return fmt.Errorf("failed to look up federation peer: %w", err)
+	}
+
+	_, err := s.db.Exec(`
+		INSERT INTO room_federation (tenant_id, room_id, server_name)
+		VALUES (?, ?, ?)
+		ON CONFLICT (tenant_id, room_id, server_name) DO NOTHING
+	`, tenantID, roomID, peerServerName)
+	if err != nil {
+		return fmt.Errorf("failed to federate room: %w", err)
+	}
+	return nil
+}
+
+// RemoteServersForRoom returns the peers tenantID's roomID is federated
+// with, if any.
+func (s *Service) RemoteServersForRoom(tenantID, roomID string) ([]RemoteServer, error) {
+	rows, err := s.db.Query(`
+		SELECT rf.server_name, fp.base_url
+		FROM room_federation rf
+		JOIN federation_peers fp ON fp.server_name = rf.server_name
+		WHERE rf.tenant_id = ? AND rf.room_id = ?
+	`, tenantID, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list room federation peers: %w", err)
+	}
+	defer rows.Close()
+
+	var servers []RemoteServer
+	for rows.Next() {
+		var rs RemoteServer
+		if err := rows.Scan(&rs.ServerName, &rs.BaseURL); err != nil {
+			return nil, fmt.Errorf("failed to scan room federation peer: %w", err)
+		}
+		servers = append(servers, rs)
+	}
+	return servers, rows.Err()
+}
+
+// sendEnvelope is the JSON body POSTed to a peer's /_federation/send, signed
+// over its own serialized bytes with this server's Ed25519 key.
+type sendEnvelope struct {
+	SourceServer string    `json:"source_server"`
+	EventID      string    `json:"event_id"`
+	TenantID     string    `json:"tenant_id"`
+	RoomID       string    `json:"room_id"`
+	SenderID     string    `json:"sender_id"`
+	Seq          int       `json:"seq"`
+	Content      string    `json:"content"`
+	Meta         string    `json:"meta,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// SendMessageEvent enqueues msg for relay to every peer tenantID's roomID is
+// federated with, if any. Delivery itself happens asynchronously via
+// ProcessPending, same as the event webhook dispatch it sits alongside, so a
+// slow or unreachable peer never blocks the send path.
+func (s *Service) SendMessageEvent(tenantID, roomID string, msg *models.Message) error {
+	servers, err := s.RemoteServersForRoom(tenantID, roomID)
+	if err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+
+	envelope := sendEnvelope{
+		SourceServer: s.serverName,
+		EventID:      msg.EventID,
+		TenantID:     tenantID,
+		RoomID:       roomID,
+		SenderID:     msg.SenderID,
+		Seq:          msg.Seq,
+		Content:      msg.Content,
+		Meta:         msg.Meta,
+		CreatedAt:    msg.CreatedAt,
+	}
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return fmt.Errorf("failed to encode federation send payload: %w", err)
+	}
+
+	for _, server := range servers {
+		_, err := s.db.Exec(`
+			INSERT INTO federation_outbox (tenant_id, room_id, server_name, event_type, payload, status)
+			VALUES (?, ?, ?, 'message.send', ?, 'pending')
+		`, tenantID, roomID, server.ServerName, string(payload))
+		if err != nil {
+			return fmt.Errorf("failed to enqueue federation outbox entry for %s: %w", server.ServerName, err)
+		}
+	}
+	return nil
+}
+
+// pendingOutbox is a single row pulled from federation_outbox, ready to be
+// attempted.
+type pendingOutbox struct {
+	id         int
+	serverName string
+	payload    string
+}
+
+// ProcessPending attempts delivery of every federation_outbox row for
+// tenantID that is pending and due for (re)try, up to limit rows, relaying
+// to peers concurrently bounded by s.workers.
+func (s *Service) ProcessPending(tenantID string, limit int) error {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id, server_name, payload
+		FROM federation_outbox
+		WHERE tenant_id = ? AND status = 'pending'
+			AND (next_retry_at IS NULL OR next_retry_at <= CURRENT_TIMESTAMP)
+		ORDER BY created_at ASC
+		LIMIT ?
+	`, tenantID, limit)
+	if err != nil {
+		return fmt.Errorf("failed to get pending federation outbox entries: %w", err)
+	}
+
+	var pending []pendingOutbox
+	for rows.Next() {
+		var p pendingOutbox
+		if err := rows.Scan(&p.id, &p.serverName, &p.payload); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan federation outbox entry: %w", err)
+		}
+		pending = append(pending, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	sem := make(chan struct{}, s.workers)
+	var wg sync.WaitGroup
+
+	for _, p := range pending {
+		p := p
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := s.attempt(p); err != nil {
+				slog.Warn("Federation send failed", "outbox_id", p.id, "peer", p.serverName, "error", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// attempt POSTs a single outbox entry's payload to its target peer, signed
+// with this server's Ed25519 key, and records the outcome.
+func (s *Service) attempt(p pendingOutbox) error {
+	var baseURL string
+	if err := s.db.QueryRow(`SELECT base_url FROM federation_peers WHERE server_name = ?`, p.serverName).Scan(&baseURL); err != nil {
+		return s.markFailed(p.id, fmt.Sprintf("unknown peer %q: %v", p.serverName, err))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/_federation/send", bytes.NewReader([]byte(p.payload)))
+	if err != nil {
+		return s.markFailed(p.id, fmt.Sprintf("failed to build request: %v", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Federation-Server", s.serverName)
+	req.Header.Set("X-Federation-Signature", hex.EncodeToString(ed25519.Sign(s.signingKey, []byte(p.payload))))
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return s.markFailed(p.id, err.Error())
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return s.markDelivered(p.id)
+	}
+	return s.markFailed(p.id, fmt.Sprintf("peer returned status %d", resp.StatusCode))
+}
+
+func (s *Service) markDelivered(id int) error {
+	_, err := s.db.Exec(`
+		UPDATE federation_outbox
+		SET status = 'delivered', attempts = attempts + 1, last_attempt_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, id)
+	return err
+}
+
+// markFailed bumps the attempt counter with exponential backoff, or moves
+// the outbox entry to the shared dead letter table once it exhausts its
+// attempts.
+func (s *Service) markFailed(id int, lastErr string) error {
+	var attempts int
+	if err := s.db.QueryRow(`SELECT attempts FROM federation_outbox WHERE id = ?`, id).Scan(&attempts); err != nil {
+		return err
+	}
+
+	if s.retryPolicy.IsTerminal(attempts) {
+		return s.moveToDeadLetter(id, attempts+1, lastErr)
+	}
+
+	nextRetryAt := s.retryPolicy.NextRetryAt(attempts, time.Now())
+	_, err := s.db.Exec(`
+		UPDATE federation_outbox
+		SET attempts = attempts + 1, last_attempt_at = CURRENT_TIMESTAMP, next_retry_at = ?, last_error = ?
+		WHERE id = ?
+	`, nextRetryAt, lastErr, id)
+	return err
+}
+
+func (s *Service) moveToDeadLetter(id, attempts int, lastErr string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE federation_outbox
+		SET status = 'dead', attempts = ?, last_attempt_at = CURRENT_TIMESTAMP, last_error = ?
+		WHERE id = ?
+	`, attempts, lastErr, id)
+	if err != nil {
+		return fmt.Errorf("failed to mark federation outbox entry dead: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO dead_letter (tenant_id, kind, ref_id, payload, last_error, attempts)
+		SELECT tenant_id, 'federation_send', CAST(id AS TEXT), server_name, ?, ?
+		FROM federation_outbox WHERE id = ?
+	`, lastErr, attempts, id)
+	if err != nil {
+		return fmt.Errorf("failed to insert dead letter entry: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// VerifyRequest checks signatureHex against body using serverName's
+// registered public key. Used both for POST /_federation/send (body is the
+// request body) and GET /_federation/backfill (body is the raw query
+// string), so a request from an unregistered or impersonating peer is
+// rejected before it reaches any handler logic.
+func (s *Service) VerifyRequest(serverName string, body []byte, signatureHex string) error {
+	var publicKeyHex string
+	if err := s.db.QueryRow(`SELECT public_key FROM federation_peers WHERE server_name = ?`, serverName).Scan(&publicKeyHex); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("unknown federation peer %q", serverName)
+		}
+		return fmt.Errorf("failed to look up federation peer: %w", err)
+	}
+
+	publicKey, err := hex.DecodeString(publicKeyHex)
+	if err != nil {
+		return fmt.Errorf("stored public key for %q is invalid: %w", serverName, err)
+	}
+	signature, err := hex.DecodeString(signatureHex)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(publicKey), body, signature) {
+		return fmt.Errorf("signature verification failed for peer %q", serverName)
+	}
+	return nil
+}
+
+// HandleIncomingSend verifies body was signed by serverName and, if so,
+// decodes it as a sendEnvelope and mirrors it into the local room via
+// message.Service.InsertFederatedMessage, preserving the original
+// sender_id and seq. Dedup on event_id means a retried relay is a no-op.
+func (s *Service) HandleIncomingSend(serverName string, body []byte, signatureHex string) (*models.Message, error) {
+	if err := s.VerifyRequest(serverName, body, signatureHex); err != nil {
+		return nil, err
+	}
+
+	var envelope sendEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, fmt.Errorf("failed to decode federation send payload: %w", err)
+	}
+
+	return s.messageSvc.InsertFederatedMessage(
+		envelope.TenantID, envelope.RoomID, envelope.EventID,
+		envelope.SenderID, envelope.Content, envelope.Meta,
+		envelope.Seq, envelope.CreatedAt,
+	)
+}
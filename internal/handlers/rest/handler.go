@@ -2,30 +2,40 @@ package rest
 
 import (
 	"encoding/json"
+	"io"
 	"log/slog"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/hastenr/chatapi/internal/config"
+	"github.com/hastenr/chatapi/internal/federation"
+	"github.com/hastenr/chatapi/internal/metrics"
 	"github.com/hastenr/chatapi/internal/models"
+	"github.com/hastenr/chatapi/internal/netutil"
+	"github.com/hastenr/chatapi/internal/ratelimit"
 	"github.com/hastenr/chatapi/internal/services/chatroom"
 	"github.com/hastenr/chatapi/internal/services/delivery"
 	"github.com/hastenr/chatapi/internal/services/message"
 	"github.com/hastenr/chatapi/internal/services/notification"
 	"github.com/hastenr/chatapi/internal/services/realtime"
 	"github.com/hastenr/chatapi/internal/services/tenant"
+	"github.com/hastenr/chatapi/internal/sync"
+	"github.com/hastenr/chatapi/internal/webhook"
 )
 
 // Handler handles REST API requests
 type Handler struct {
-	tenantSvc   *tenant.Service
-	chatroomSvc *chatroom.Service
-	messageSvc  *message.Service
-	realtimeSvc *realtime.Service
-	deliverySvc *delivery.Service
-	notifSvc    *notification.Service
-	config      *config.Config
-	startTime   time.Time
+	tenantSvc     *tenant.Service
+	chatroomSvc   *chatroom.Service
+	messageSvc    *message.Service
+	realtimeSvc   *realtime.Service
+	deliverySvc   *delivery.Service
+	notifSvc      *notification.Service
+	webhookSvc    *webhook.Service
+	federationSvc *federation.Service
+	config        *config.Config
+	startTime     time.Time
 }
 
 // NewHandler creates a new REST handler
@@ -36,17 +46,21 @@ func NewHandler(
 	realtimeSvc *realtime.Service,
 	deliverySvc *delivery.Service,
 	notifSvc *notification.Service,
+	webhookSvc *webhook.Service,
+	federationSvc *federation.Service,
 	config *config.Config,
 ) *Handler {
 	return &Handler{
-		tenantSvc:   tenantSvc,
-		chatroomSvc: chatroomSvc,
-		messageSvc:  messageSvc,
-		realtimeSvc: realtimeSvc,
-		deliverySvc: deliverySvc,
-		notifSvc:    notifSvc,
-		config:      config,
-		startTime:   time.Now(),
+		tenantSvc:     tenantSvc,
+		chatroomSvc:   chatroomSvc,
+		messageSvc:    messageSvc,
+		realtimeSvc:   realtimeSvc,
+		deliverySvc:   deliverySvc,
+		notifSvc:      notifSvc,
+		webhookSvc:    webhookSvc,
+		federationSvc: federationSvc,
+		config:        config,
+		startTime:     time.Now(),
 	}
 }
 
@@ -54,12 +68,17 @@ func NewHandler(
 func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 	// Health check
 	mux.HandleFunc("GET /health", h.HandleHealth)
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.HandleFunc("GET /debug/wire-stats", h.HandleWireStats)
 
 	// Rooms
 	mux.HandleFunc("POST /rooms", h.HandleCreateRoom)
 	mux.HandleFunc("GET /rooms/{room_id}", h.HandleGetRoom)
 	mux.HandleFunc("GET /rooms/{room_id}/members", h.HandleGetRoomMembers)
 
+	// Sliding sync
+	mux.HandleFunc("POST /sync", h.HandleSlidingSync)
+
 	// Messages
 	mux.HandleFunc("POST /rooms/{room_id}/messages", h.HandleSendMessage)
 	mux.HandleFunc("GET /rooms/{room_id}/messages", h.HandleGetMessages)
@@ -69,10 +88,20 @@ func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
 
 	// Notifications
 	mux.HandleFunc("POST /notify", h.HandleNotify)
+	mux.HandleFunc("GET /topics/{topic}/messages", h.HandleGetTopicMessages)
 
 	// Admin
 	mux.HandleFunc("POST /admin/tenants", h.HandleCreateTenant)
+	mux.HandleFunc("POST /admin/tenants/{tenant_id}/webhook", h.HandleConfigureWebhook)
+	mux.HandleFunc("POST /admin/federation/peers", h.HandleRegisterFederationPeer)
+	mux.HandleFunc("POST /admin/tenants/{tenant_id}/rooms/{room_id}/federation", h.HandleFederateRoom)
 	mux.HandleFunc("GET /admin/dead-letters", h.HandleGetDeadLetters)
+	mux.HandleFunc("GET /admin/messages/dead-letter", h.HandleListMessageDeadLetters)
+	mux.HandleFunc("POST /admin/messages/dead-letter/{id}/requeue", h.HandleRequeueMessageDeadLetter)
+
+	// Federation (server-to-server, not a tenant API)
+	mux.HandleFunc("POST /_federation/send", h.HandleFederationSend)
+	mux.HandleFunc("GET /_federation/backfill", h.HandleFederationBackfill)
 }
 
 // AuthMiddleware for authentication and tenant validation
@@ -92,9 +121,16 @@ func (h *Handler) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		// Check rate limit
-		if err := h.tenantSvc.CheckRateLimit(tenant.TenantID); err != nil {
-			w.Header().Set("Retry-After", "60")
+		// Check rate limit. routeKey is the pattern this request was
+		// dispatched on, which already starts with its method (e.g.
+		// "POST /rooms/{room_id}/messages"), set by ServeMux before it calls
+		// us, so per-route buckets aren't keyed by literal path and don't
+		// fragment per room/message ID.
+		routeKey := r.Pattern
+		clientIP := netutil.ClientIP(r, h.config.TrustedProxies)
+		decision := h.tenantSvc.CheckRateLimit(tenant.TenantID, routeKey, clientIP)
+		setRateLimitHeaders(w, decision)
+		if !decision.Allowed {
 			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 			return
 		}
@@ -102,10 +138,31 @@ func (h *Handler) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		// Add tenant to request context (simplified - in production use context.WithValue)
 		r.Header.Set("X-Tenant-ID", tenant.TenantID)
 
+		// Carry clientIP through the request context so handlers further
+		// down (e.g. message.Service.SendMessage's audit log) don't need to
+		// re-derive it from headers.
+		r = r.WithContext(netutil.WithClientIP(r.Context(), clientIP))
+
 		next(w, r)
 	}
 }
 
+// setRateLimitHeaders sets the X-RateLimit-* headers from decision, plus
+// Retry-After if the request was rejected.
+func setRateLimitHeaders(w http.ResponseWriter, decision ratelimit.Decision) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(decision.ResetAt.Unix(), 10))
+	w.Header().Set("X-RateLimit-Bucket", decision.Bucket)
+	if !decision.Allowed {
+		retryAfter := int(time.Until(decision.ResetAt).Seconds())
+		if retryAfter < 0 {
+			retryAfter = 0
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+}
+
 // getTenantID extracts tenant ID from request
 func (h *Handler) getTenantID(r *http.Request) string {
 	return r.Header.Get("X-Tenant-ID")
@@ -126,7 +183,11 @@ func (h *Handler) requireUserID(w http.ResponseWriter, r *http.Request) string {
 	return userID
 }
 
-// HandleHealth health check endpoint
+// HandleHealth health check endpoint. With ?verbose=1 it also reports
+// broker connectivity, broadcast channel saturation, and per-tenant
+// connection counts, so an operator can see the "channel full, dropping"
+// condition (see realtime.Service.broadcastSequenced) building up instead
+// of only finding out once it's already in the logs.
 func (h *Handler) HandleHealth(w http.ResponseWriter, r *http.Request) {
 	uptime := time.Since(h.startTime)
 
@@ -140,6 +201,16 @@ func (h *Handler) HandleHealth(w http.ResponseWriter, r *http.Request) {
 		"db_writable": dbWritable,
 	}
 
+	if r.URL.Query().Get("verbose") == "1" {
+		depth, capacity := h.realtimeSvc.BroadcastQueueSaturation()
+		response["broker_connected"] = h.realtimeSvc.BrokerHealthy()
+		response["broadcast_queue"] = map[string]interface{}{
+			"depth":    depth,
+			"capacity": capacity,
+		}
+		response["connections_by_tenant"] = h.realtimeSvc.ConnectionCountsByTenant()
+	}
+
 	// Return error status if DB is not writable
 	if !dbWritable {
 		response["status"] = "error"
@@ -179,6 +250,10 @@ func (h *Handler) HandleCreateRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := h.webhookSvc.DispatchEvent(tenantID, "room.created", room.RoomID, room); err != nil {
+		slog.Warn("Failed to enqueue room.created event webhook", "error", err, "tenant_id", tenantID, "room_id", room.RoomID)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(room)
 }
@@ -215,6 +290,36 @@ func (h *Handler) HandleGetRoomMembers(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// HandleSlidingSync sliding sync endpoint: windowed, incremental room list sync
+func (h *Handler) HandleSlidingSync(w http.ResponseWriter, r *http.Request) {
+	tenantID := h.getTenantID(r)
+	userID := h.requireUserID(w, r)
+	if userID == "" {
+		return
+	}
+
+	sessionID := r.Header.Get("X-Session-Id")
+	if sessionID == "" {
+		sessionID = userID
+	}
+
+	var req sync.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.chatroomSvc.SlidingSync(tenantID, userID, sessionID, &req)
+	if err != nil {
+		slog.Error("Sliding sync failed", "error", err, "tenant_id", tenantID, "user_id", userID)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
 // HandleSendMessage send message endpoint
 func (h *Handler) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
 	tenantID := h.getTenantID(r)
@@ -231,15 +336,16 @@ func (h *Handler) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	message, err := h.messageSvc.SendMessage(tenantID, roomID, userID, &req)
+	message, err := h.messageSvc.SendMessage(r.Context(), tenantID, roomID, userID, &req)
 	if err != nil {
 		slog.Error("Failed to send message", "error", err, "tenant_id", tenantID, "user_id", userID, "room_id", roomID)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Broadcast to realtime subscribers
-	h.realtimeSvc.BroadcastToRoom(tenantID, roomID, map[string]interface{}{
+	// Broadcast to realtime subscribers, local and (if configured) on other
+	// nodes sharing this cluster's backplane
+	h.realtimeSvc.BroadcastMessage(tenantID, roomID, message.MessageID, int64(message.Seq), map[string]interface{}{
 		"type":       "message",
 		"room_id":    roomID,
 		"seq":        message.Seq,
@@ -249,6 +355,14 @@ func (h *Handler) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
 		"created_at": message.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
 	})
 
+	if err := h.webhookSvc.DispatchEvent(tenantID, "message.sent", roomID, message); err != nil {
+		slog.Warn("Failed to enqueue message.sent event webhook", "error", err, "tenant_id", tenantID, "room_id", roomID)
+	}
+
+	if err := h.federationSvc.SendMessageEvent(tenantID, roomID, message); err != nil {
+		slog.Warn("Failed to enqueue federation relay", "error", err, "tenant_id", tenantID, "room_id", roomID)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(message)
 }
@@ -304,14 +418,23 @@ func (h *Handler) HandleAck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Broadcast ACK to other room members
-	h.realtimeSvc.BroadcastToRoom(tenantID, req.RoomID, map[string]interface{}{
+	// Broadcast ACK to other room members, local and (if configured) on
+	// other nodes sharing this cluster's backplane
+	h.realtimeSvc.BroadcastAck(tenantID, req.RoomID, userID, req.Seq, map[string]interface{}{
 		"type":    "ack.received",
 		"room_id": req.RoomID,
 		"seq":     req.Seq,
 		"user_id": userID,
 	})
 
+	if err := h.webhookSvc.DispatchEvent(tenantID, "message.ack", req.RoomID, map[string]interface{}{
+		"room_id": req.RoomID,
+		"seq":     req.Seq,
+		"user_id": userID,
+	}); err != nil {
+		slog.Warn("Failed to enqueue message.ack event webhook", "error", err, "tenant_id", tenantID, "room_id", req.RoomID)
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -337,6 +460,39 @@ func (h *Handler) HandleNotify(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(notification)
 }
 
+// HandleGetTopicMessages reads a topic's topiclog WAL for catch-up, e.g. a
+// client that missed its WebSocket subscribe window and needs to fetch what
+// it missed over REST instead.
+func (h *Handler) HandleGetTopicMessages(w http.ResponseWriter, r *http.Request) {
+	tenantID := h.getTenantID(r)
+	topic := r.PathValue("topic")
+
+	fromSeq := uint64(0)
+	if from := r.URL.Query().Get("from_seq"); from != "" {
+		if seq, err := strconv.ParseUint(from, 10, 64); err == nil {
+			fromSeq = seq
+		}
+	}
+
+	limit := 50
+	if lim := r.URL.Query().Get("limit"); lim != "" {
+		if l, err := strconv.Atoi(lim); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	messages, err := h.notifSvc.ReadTopic(tenantID, topic, fromSeq, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages": messages,
+	})
+}
+
 // HandleCreateTenant creates a new tenant (admin only)
 func (h *Handler) HandleCreateTenant(w http.ResponseWriter, r *http.Request) {
 	// Check master API key
@@ -373,6 +529,173 @@ func (h *Handler) HandleCreateTenant(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(tenant)
 }
 
+// HandleConfigureWebhook sets or clears the event webhook URL/secret a
+// tenant's message/ack/presence/room-create events are dispatched to
+// (admin only). Passing an empty url disables dispatch for the tenant.
+func (h *Handler) HandleConfigureWebhook(w http.ResponseWriter, r *http.Request) {
+	masterKey := r.Header.Get("X-Master-Key")
+	if masterKey == "" || masterKey != h.config.MasterAPIKey {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tenantID := r.PathValue("tenant_id")
+
+	var req struct {
+		URL    string `json:"url"`
+		Secret string `json:"secret,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.tenantSvc.SetWebhookConfig(tenantID, req.URL, req.Secret); err != nil {
+		slog.Error("Failed to configure tenant webhook", "error", err, "tenant_id", tenantID)
+		http.Error(w, "Failed to configure webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRegisterFederationPeer records a peer ChatAPI deployment's base URL
+// and Ed25519 public key (admin only), so rooms can subsequently be
+// federated with it via HandleFederateRoom.
+func (h *Handler) HandleRegisterFederationPeer(w http.ResponseWriter, r *http.Request) {
+	masterKey := r.Header.Get("X-Master-Key")
+	if masterKey == "" || masterKey != h.config.MasterAPIKey {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		ServerName string `json:"server_name"`
+		BaseURL    string `json:"base_url"`
+		PublicKey  string `json:"public_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.ServerName == "" || req.BaseURL == "" || req.PublicKey == "" {
+		http.Error(w, "server_name, base_url and public_key are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.federationSvc.RegisterPeer(req.ServerName, req.BaseURL, req.PublicKey); err != nil {
+		slog.Error("Failed to register federation peer", "error", err, "server_name", req.ServerName)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"public_key": h.federationSvc.PublicKeyHex()})
+}
+
+// HandleFederateRoom shares tenantID's room with an already-registered peer
+// (admin only), so its messages are relayed there going forward.
+func (h *Handler) HandleFederateRoom(w http.ResponseWriter, r *http.Request) {
+	masterKey := r.Header.Get("X-Master-Key")
+	if masterKey == "" || masterKey != h.config.MasterAPIKey {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tenantID := r.PathValue("tenant_id")
+	roomID := r.PathValue("room_id")
+
+	var req struct {
+		ServerName string `json:"server_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.federationSvc.IncludeRoom(tenantID, roomID, req.ServerName); err != nil {
+		slog.Error("Failed to federate room", "error", err, "tenant_id", tenantID, "room_id", roomID, "server_name", req.ServerName)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleFederationSend is the inbound relay endpoint a peer POSTs a message
+// to once it's been sent in a room we share (see federation.Service's doc
+// comment). It authenticates via X-Federation-Server/X-Federation-Signature
+// instead of AuthMiddleware's per-tenant X-API-Key, since the caller is
+// another server, not one of our own tenants.
+func (h *Handler) HandleFederationSend(w http.ResponseWriter, r *http.Request) {
+	serverName := r.Header.Get("X-Federation-Server")
+	signature := r.Header.Get("X-Federation-Signature")
+	if serverName == "" || signature == "" {
+		http.Error(w, "Missing federation headers", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	msg, err := h.federationSvc.HandleIncomingSend(serverName, body, signature)
+	if err != nil {
+		slog.Warn("Rejected federation send", "error", err, "server_name", serverName)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+// HandleFederationBackfill lets a peer catch up on a federated room's
+// history, authenticated the same way as HandleFederationSend but signed
+// over the request's raw query string instead of a body, since GET requests
+// have none.
+func (h *Handler) HandleFederationBackfill(w http.ResponseWriter, r *http.Request) {
+	serverName := r.Header.Get("X-Federation-Server")
+	signature := r.Header.Get("X-Federation-Signature")
+	if serverName == "" || signature == "" {
+		http.Error(w, "Missing federation headers", http.StatusUnauthorized)
+		return
+	}
+	if err := h.federationSvc.VerifyRequest(serverName, []byte(r.URL.RawQuery), signature); err != nil {
+		slog.Warn("Rejected federation backfill", "error", err, "server_name", serverName)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tenantID := r.URL.Query().Get("tenant_id")
+	roomID := r.URL.Query().Get("room_id")
+	afterSeq := 0
+	if after := r.URL.Query().Get("after_seq"); after != "" {
+		if seq, err := strconv.Atoi(after); err == nil {
+			afterSeq = seq
+		}
+	}
+	limit := 100
+	if lim := r.URL.Query().Get("limit"); lim != "" {
+		if l, err := strconv.Atoi(lim); err == nil && l > 0 && l <= 1000 {
+			limit = l
+		}
+	}
+
+	messages, err := h.messageSvc.GetMessages(tenantID, roomID, afterSeq, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages": messages,
+	})
+}
+
 // HandleGetDeadLetters admin endpoint to get failed deliveries
 func (h *Handler) HandleGetDeadLetters(w http.ResponseWriter, r *http.Request) {
 	tenantID := h.getTenantID(r)
@@ -385,25 +708,84 @@ func (h *Handler) HandleGetDeadLetters(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Get failed notifications
-	failedNotifications, err := h.notifSvc.GetFailedNotifications(tenantID, limit)
+	// Dead-letter entries cover messages, notifications, and webhook
+	// deliveries alike - they all land in the same shared table once they
+	// exhaust their retries
+	entries, err := h.deliverySvc.GetDeadLetters(tenantID, limit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Get failed undelivered messages
-	failedMessages, err := h.messageSvc.GetFailedUndeliveredMessages(tenantID, limit)
+	response := map[string]interface{}{
+		"dead_letters": entries,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleWireStats reports outbound WebSocket wire stats (frame counts and
+// byte totals, by message type) so operators can quantify the bandwidth
+// savings from a tenant negotiating a binary/compressing subprotocol over
+// JSON. Superseded as the default "/metrics" endpoint by the Prometheus
+// exposition registered in RegisterRoutes (see internal/metrics), but kept
+// at its own path since it answers a narrower, JSON-friendly question a
+// scrape target doesn't.
+func (h *Handler) HandleWireStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(realtime.SnapshotWireStats())
+}
+
+// HandleListMessageDeadLetters admin endpoint to page through message
+// deliveries that exhausted their retries
+func (h *Handler) HandleListMessageDeadLetters(w http.ResponseWriter, r *http.Request) {
+	tenantID := h.getTenantID(r)
+
+	limit := 100
+	if lim := r.URL.Query().Get("limit"); lim != "" {
+		if l, err := strconv.Atoi(lim); err == nil && l > 0 && l <= 1000 {
+			limit = l
+		}
+	}
+
+	afterID := 0
+	if after := r.URL.Query().Get("after_id"); after != "" {
+		if a, err := strconv.Atoi(after); err == nil && a > 0 {
+			afterID = a
+		}
+	}
+
+	entries, err := h.messageSvc.ListDeadLetter(tenantID, limit, afterID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	response := map[string]interface{}{
-		"failed_notifications": failedNotifications,
-		"failed_messages":      failedMessages,
+		"dead_letters": entries,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
+
+// HandleRequeueMessageDeadLetter admin endpoint to move a message
+// dead-letter entry back onto the undelivered_messages queue for retry
+func (h *Handler) HandleRequeueMessageDeadLetter(w http.ResponseWriter, r *http.Request) {
+	tenantID := h.getTenantID(r)
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid dead-letter id", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.messageSvc.RequeueDeadLetter(tenantID, id); err != nil {
+		slog.Error("Failed to requeue dead-letter message", "error", err, "id", id)
+		http.Error(w, "Failed to requeue dead-letter message", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
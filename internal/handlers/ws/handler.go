@@ -1,17 +1,26 @@
 package ws
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"math/rand"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/Byabasaija/chatapi/internal/models"
-	"github.com/Byabasaija/chatapi/internal/services/chatroom"
-	"github.com/Byabasaija/chatapi/internal/services/message"
-	"github.com/Byabasaija/chatapi/internal/services/realtime"
-	"github.com/Byabasaija/chatapi/internal/services/tenant"
+	"github.com/hastenr/chatapi/internal/models"
+	"github.com/hastenr/chatapi/internal/netutil"
+	"github.com/hastenr/chatapi/internal/services/chatroom"
+	"github.com/hastenr/chatapi/internal/services/message"
+	"github.com/hastenr/chatapi/internal/services/notification"
+	"github.com/hastenr/chatapi/internal/services/realtime"
+	tenantsvc "github.com/hastenr/chatapi/internal/services/tenant"
+	"github.com/hastenr/chatapi/internal/webhook"
+	"github.com/hastenr/chatapi/internal/wssession"
 )
 
 var upgrader = websocket.Upgrader{
@@ -19,28 +28,83 @@ var upgrader = websocket.Upgrader{
 		// In production, implement proper origin checking
 		return true
 	},
+	Subprotocols: realtime.SupportedSubprotocols,
+
+	// permessage-deflate, negotiated independently of the msgpack-br
+	// subprotocols above: those compress application-level frame bytes with
+	// brotli, this compresses at the WebSocket extension level, so even a
+	// plain JSON connection that doesn't ask for a binary subprotocol still
+	// gets compression on the wire.
+	EnableCompression: true,
 }
 
+// jsonOnlySubprotocols is offered instead of realtime.SupportedSubprotocols
+// to a tenant whose TenantConfig.BinaryProtocol is false, so its clients
+// never negotiate a binary (msgpack) subprotocol even if they ask for one.
+var jsonOnlySubprotocols = []string{realtime.SubprotocolJSON}
+
+// Ping/pong zombie detection, Discord gateway-style: the server pings every
+// pingPeriod and expects a pong within pongWait of the last one received
+// (or of connecting); a client that stops responding is reaped instead of
+// held open as a half-open connection.
+const (
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
+)
+
+// reconnectDelayMin/Max bound the jittered reconnect delay hint the server
+// sends in its close frame when it closes a connection, so many clients
+// dropped at once (e.g. a node restart) don't all reconnect in the same
+// instant.
+const (
+	reconnectDelayMin = 1 * time.Second
+	reconnectDelayMax = 5 * time.Second
+)
+
 // Handler handles WebSocket connections
 type Handler struct {
-	tenantSvc   *tenant.Service
-	chatroomSvc *chatroom.Service
-	messageSvc  *message.Service
-	realtimeSvc *realtime.Service
+	tenantSvc            *tenantsvc.Service
+	chatroomSvc          *chatroom.Service
+	messageSvc           *message.Service
+	realtimeSvc          *realtime.Service
+	notifSvc             *notification.Service
+	webhookSvc           *webhook.Service
+	sessions             *wssession.Store
+	maxReplay            int
+	compressionThreshold int
+	trustedProxies       []netip.Prefix
 }
 
-// NewHandler creates a new WebSocket handler
+// NewHandler creates a new WebSocket handler. sessions tracks resumable
+// sessions across reconnects; maxReplay bounds how many missed messages a
+// resume will replay per room before the gap is considered out of window;
+// compressionThreshold is the minimum encoded frame size, in bytes, at which
+// a connection that negotiated a compressing subprotocol actually compresses
+// (see realtime.CodecForSubprotocol); trustedProxies is passed straight
+// through to netutil.ClientIP for rate limiting and audit logging.
 func NewHandler(
-	tenantSvc *tenant.Service,
+	tenantSvc *tenantsvc.Service,
 	chatroomSvc *chatroom.Service,
 	messageSvc *message.Service,
 	realtimeSvc *realtime.Service,
+	notifSvc *notification.Service,
+	webhookSvc *webhook.Service,
+	sessions *wssession.Store,
+	maxReplay int,
+	compressionThreshold int,
+	trustedProxies []netip.Prefix,
 ) *Handler {
 	return &Handler{
-		tenantSvc:   tenantSvc,
-		chatroomSvc: chatroomSvc,
-		messageSvc:  messageSvc,
-		realtimeSvc: realtimeSvc,
+		tenantSvc:            tenantSvc,
+		chatroomSvc:          chatroomSvc,
+		messageSvc:           messageSvc,
+		realtimeSvc:          realtimeSvc,
+		notifSvc:             notifSvc,
+		webhookSvc:           webhookSvc,
+		sessions:             sessions,
+		maxReplay:            maxReplay,
+		compressionThreshold: compressionThreshold,
+		trustedProxies:       trustedProxies,
 	}
 }
 
@@ -71,100 +135,354 @@ func (h *Handler) HandleConnection(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check rate limit
-	if err := h.tenantSvc.CheckRateLimit(tenant.TenantID); err != nil {
+	clientIP := netutil.ClientIP(r, h.trustedProxies)
+	decision := h.tenantSvc.CheckRateLimit(tenant.TenantID, tenantsvc.RouteWS, clientIP)
+	if !decision.Allowed {
+		retryAfter := int(time.Until(decision.ResetAt).Seconds())
+		if retryAfter < 0 {
+			retryAfter = 0
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
 		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 		return
 	}
 
-	// Upgrade to WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Upgrade to WebSocket. A tenant with BinaryProtocol disabled only ever
+	// offers the JSON subprotocol, regardless of what the client asks for.
+	connUpgrader := upgrader
+	if cfg, err := h.tenantSvc.GetTenantConfig(tenant.TenantID); err == nil && !cfg.BinaryProtocol {
+		connUpgrader.Subprotocols = jsonOnlySubprotocols
+	}
+
+	conn, err := connUpgrader.Upgrade(w, r, nil)
 	if err != nil {
 		slog.Error("Failed to upgrade connection", "error", err)
 		return
 	}
+	conn.EnableWriteCompression(true)
+
+	// codec is fixed for the lifetime of the connection by whatever
+	// subprotocol it negotiated during Upgrade (see upgrader.Subprotocols);
+	// an empty Subprotocol() means the client didn't ask for one and it
+	// falls back to plain JSON, unchanged from before subprotocols existed.
+	codec := realtime.CodecForSubprotocol(conn.Subprotocol(), h.compressionThreshold)
+
+	// Start connection handler. It negotiates session resume (or issues a
+	// fresh session) itself before registering the connection, since a
+	// failed resume must not register or broadcast presence for a
+	// connection the server is about to close. A fresh background context
+	// is used rather than r.Context(), since r's context is cancelled once
+	// this handler returns but the connection outlives it; clientIP is
+	// carried along so it reaches message.Service.SendMessage's audit log.
+	ctx := netutil.WithClientIP(context.Background(), clientIP)
+	go h.handleConnection(ctx, tenant.TenantID, userID, conn, codec)
+}
 
-	// Register connection
-	h.realtimeSvc.RegisterConnection(tenant.TenantID, userID, conn)
-
-	// Send presence update
-	h.realtimeSvc.BroadcastPresenceUpdate(tenant.TenantID, userID, "online")
+// handleConnection owns a WebSocket connection end to end: session
+// negotiation, ping/pong zombie detection, and the read loop.
+func (h *Handler) handleConnection(ctx context.Context, tenantID, userID string, conn *websocket.Conn, codec realtime.Codec) {
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
 
-	// Handle reconnect sync - send missed messages
-	go h.handleReconnectSync(tenant.TenantID, userID, conn)
+	sessionID, firstMsg, delivered, ok := h.negotiateSession(tenantID, userID, conn, codec)
+	if !ok {
+		return
+	}
+	slog.Info("WebSocket session established", "tenant_id", tenantID, "user_id", userID, "session_id", sessionID)
 
-	// Start connection handler
-	go h.handleConnection(tenant.TenantID, userID, conn)
-}
+	session := h.realtimeSvc.RegisterConnection(tenantID, userID, conn, codec)
+	for roomID, seq := range delivered {
+		session.MarkDelivered(roomID, seq)
+	}
+	h.realtimeSvc.BroadcastPresenceUpdate(tenantID, userID, "online")
+	if err := h.webhookSvc.DispatchEvent(tenantID, "presence.update", "", map[string]interface{}{
+		"user_id": userID,
+		"status":  "online",
+	}); err != nil {
+		slog.Warn("Failed to enqueue presence.update event webhook", "error", err, "tenant_id", tenantID, "user_id", userID)
+	}
 
-// handleReconnectSync sends missed messages to a reconnecting client
-func (h *Handler) handleReconnectSync(tenantID, userID string, conn *websocket.Conn) {
-	// Get user's rooms
-	// This is a simplified implementation - in practice you'd query the database
-	// for rooms the user is a member of
-
-	// For now, we'll skip this and let the client request messages as needed
-	// In a full implementation, you'd:
-	// 1. Get user's rooms from database
-	// 2. For each room, get last_ack
-	// 3. Query messages where seq > last_ack
-	// 4. Send them in order
-}
+	stopPing := make(chan struct{})
+	go h.pingLoop(conn, stopPing)
 
-// handleConnection handles messages from a WebSocket connection
-func (h *Handler) handleConnection(tenantID, userID string, conn *websocket.Conn) {
 	defer func() {
+		close(stopPing)
 		h.realtimeSvc.UnregisterConnection(tenantID, userID, conn)
+		h.realtimeSvc.BroadcastPresenceUpdate(tenantID, userID, "offline")
+		if err := h.webhookSvc.DispatchEvent(tenantID, "presence.update", "", map[string]interface{}{
+			"user_id": userID,
+			"status":  "offline",
+		}); err != nil {
+			slog.Warn("Failed to enqueue presence.update event webhook", "error", err, "tenant_id", tenantID, "user_id", userID)
+		}
 		conn.Close()
 	}()
 
-	// Set read deadline
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		return nil
-	})
+	if firstMsg != nil {
+		h.dispatch(ctx, tenantID, userID, sessionID, session, firstMsg)
+	}
 
 	for {
-		_, message, err := conn.ReadMessage()
+		messageType, raw, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				slog.Warn("WebSocket error", "tenant_id", tenantID, "user_id", userID, "error", err)
 			}
-			break
+			return
 		}
 
-		// Reset read deadline
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-
-		// Parse message
-		var wsMsg models.WSMessage
-		if err := json.Unmarshal(message, &wsMsg); err != nil {
+		wsMsg, err := decodeWSMessage(codec, raw, messageType)
+		if err != nil {
 			slog.Warn("Invalid WebSocket message", "tenant_id", tenantID, "user_id", userID, "error", err)
 			continue
 		}
 
-		// Handle message based on type
-		if err := h.handleMessage(tenantID, userID, &wsMsg); err != nil {
-			slog.Error("Failed to handle WebSocket message",
-				"tenant_id", tenantID,
-				"user_id", userID,
-				"type", wsMsg.Type,
-				"error", err)
+		h.dispatch(ctx, tenantID, userID, sessionID, session, wsMsg)
+	}
+}
+
+// decodeWSMessage decodes raw via codec and re-marshals the generic result
+// through JSON into a typed models.WSMessage, so the rest of the handler can
+// keep working with the same typed struct regardless of which wire format
+// the connection actually negotiated.
+func decodeWSMessage(codec realtime.Codec, raw []byte, messageType int) (*models.WSMessage, error) {
+	v, err := codec.Decode(raw, messageType)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var wsMsg models.WSMessage
+	if err := json.Unmarshal(b, &wsMsg); err != nil {
+		return nil, err
+	}
+	return &wsMsg, nil
+}
+
+// decodePayload re-marshals a WSMessage.Data value (already decoded
+// generically by decodeWSMessage) into a typed payload struct, so handlers
+// work with typed fields instead of repeating the
+// data.(map[string]interface{}) type-assertion dance for every message
+// type.
+func decodePayload[T any](data interface{}) (T, error) {
+	var payload T
+	b, err := json.Marshal(data)
+	if err != nil {
+		return payload, err
+	}
+	err = json.Unmarshal(b, &payload)
+	return payload, err
+}
+
+// dispatch runs handleMessage and logs any error, the shared tail of both
+// the negotiated first frame and every frame read afterwards.
+func (h *Handler) dispatch(ctx context.Context, tenantID, userID, sessionID string, session *realtime.Session, wsMsg *models.WSMessage) {
+	if err := h.handleMessage(ctx, tenantID, userID, sessionID, session, wsMsg); err != nil {
+		slog.Error("Failed to handle WebSocket message",
+			"tenant_id", tenantID,
+			"user_id", userID,
+			"type", wsMsg.Type,
+			"error", err)
+	}
+}
+
+// pingLoop sends a ping every pingPeriod until stopCh is closed or a ping
+// fails to write (the connection is on its way out either way).
+func (h *Handler) pingLoop(conn *websocket.Conn, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// negotiateSession reads the first frame of a new connection. If it is a
+// resume request for a session still known to h.sessions, it replays
+// missed messages per room and returns the resumed session_id along with
+// delivered, the highest seq replayed per room, for the caller to seed the
+// new Session's dedup state with (see Session.MarkDelivered) before live
+// fan-out can reach it. Otherwise a new session is issued, and the first
+// frame (if any, and not a failed resume) is returned for the caller to
+// dispatch normally. ok is false if the connection was closed as part of
+// negotiation (rejected resume or a read error) and the caller must not
+// proceed.
+func (h *Handler) negotiateSession(tenantID, userID string, conn *websocket.Conn, codec realtime.Codec) (sessionID string, firstMsg *models.WSMessage, delivered map[string]int, ok bool) {
+	messageType, raw, err := conn.ReadMessage()
+	if err != nil {
+		conn.Close()
+		return "", nil, nil, false
+	}
+
+	wsMsg, decodeErr := decodeWSMessage(codec, raw, messageType)
+	if decodeErr != nil {
+		wsMsg = &models.WSMessage{}
+	}
+	if decodeErr == nil && wsMsg.Type == "resume" {
+		var resumeReq models.WSResumeRequest
+		v, err := codec.Decode(raw, messageType)
+		if err == nil {
+			b, err2 := json.Marshal(v)
+			if err2 == nil {
+				err = json.Unmarshal(b, &resumeReq)
+			} else {
+				err = err2
+			}
+		}
+		if err != nil || !h.sessions.Resume(tenantID, userID, resumeReq.SessionID) {
+			h.sendInvalidSession(conn, codec)
+			return "", nil, nil, false
+		}
+		delivered, err := h.replayMissed(tenantID, resumeReq, conn, codec)
+		if err != nil {
+			h.sendInvalidSession(conn, codec)
+			return "", nil, nil, false
+		}
+		return resumeReq.SessionID, nil, delivered, true
+	}
+
+	sess, err := h.sessions.Create(tenantID, userID)
+	if err != nil {
+		slog.Error("Failed to create WebSocket session", "tenant_id", tenantID, "user_id", userID, "error", err)
+		conn.Close()
+		return "", nil, nil, false
+	}
+	if err := writeCodecMessage(conn, codec, map[string]interface{}{
+		"type":       "session.ready",
+		"session_id": sess.SessionID,
+	}); err != nil {
+		conn.Close()
+		return "", nil, nil, false
+	}
+	return sess.SessionID, wsMsg, nil, true
+}
+
+// writeCodecMessage encodes v with codec and writes it as a single WebSocket
+// frame, the codec-aware replacement for (*websocket.Conn).WriteJSON.
+func writeCodecMessage(conn *websocket.Conn, codec realtime.Codec, v interface{}) error {
+	b, messageType, err := codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(messageType, b)
+}
+
+// replayMissed sends, in order, every message with seq > req.LastSeq[roomID]
+// for each room in req.LastSeq, this connection's resume-over-WebSocket
+// counterpart to HandleGetMessages' REST after_seq pagination. It returns
+// an error if any room's gap exceeds h.maxReplay (the configured
+// WSResumeMaxReplay bound), since that means the client fell too far
+// behind for a cheap replay and should do a fresh connect + REST catch-up
+// instead. On success it sends a trailing sync.complete frame and returns
+// delivered, the highest seq actually sent per room, so the caller can seed
+// the new connection's Session with it before live fan-out is switched on
+// (see Session.MarkDelivered).
+func (h *Handler) replayMissed(tenantID string, req models.WSResumeRequest, conn *websocket.Conn, codec realtime.Codec) (map[string]int, error) {
+	delivered := make(map[string]int, len(req.LastSeq))
+	for roomID, lastSeq := range req.LastSeq {
+		// GetMessages caps a single call at 100 messages, so the gap is read
+		// page by page until it ends or is known to exceed h.maxReplay.
+		var messages []*models.Message
+		after := lastSeq
+		for len(messages) <= h.maxReplay {
+			page, err := h.messageSvc.GetMessages(tenantID, roomID, after, 100)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, page...)
+			if len(page) < 100 {
+				break
+			}
+			after = page[len(page)-1].Seq
+		}
+		if len(messages) > h.maxReplay {
+			return nil, fmt.Errorf("resume gap for room %s exceeds max replay window", roomID)
+		}
+		delivered[roomID] = lastSeq
+		for _, msg := range messages {
+			if err := writeCodecMessage(conn, codec, map[string]interface{}{
+				"type":       "message",
+				"room_id":    roomID,
+				"seq":        msg.Seq,
+				"message_id": msg.MessageID,
+				"sender_id":  msg.SenderID,
+				"content":    msg.Content,
+				"created_at": msg.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
+				"replayed":   true,
+			}); err != nil {
+				return nil, err
+			}
+			delivered[roomID] = msg.Seq
 		}
 	}
+
+	if err := writeCodecMessage(conn, codec, map[string]interface{}{
+		"type":    "sync.complete",
+		"cursors": delivered,
+	}); err != nil {
+		return nil, err
+	}
+
+	return delivered, nil
+}
+
+// sendInvalidSession tells the client its resume was rejected and closes
+// the connection with a jittered reconnect delay hint so many clients
+// rejected at once (e.g. after this node restarts) don't reconnect in a
+// thundering herd.
+func (h *Handler) sendInvalidSession(conn *websocket.Conn, codec realtime.Codec) {
+	_ = writeCodecMessage(conn, codec, map[string]interface{}{"type": "invalid_session"})
+
+	delay := reconnectDelayMin + time.Duration(rand.Int63n(int64(reconnectDelayMax-reconnectDelayMin)))
+	reason := fmt.Sprintf(`{"reconnect_after_ms":%d}`, delay.Milliseconds())
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason)
+	_ = conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(5*time.Second))
+	conn.Close()
 }
 
-// handleMessage processes different types of WebSocket messages
-func (h *Handler) handleMessage(tenantID, userID string, msg *models.WSMessage) error {
+// handleMessage processes different types of WebSocket messages. "message"
+// is the client-initiated counterpart of the bidirectional protocol and
+// shares handleSendMessage's implementation with the older "send_message"
+// name; "hello"/"bye"/"join"/"leave"/"flags" are the rest of that protocol
+// (see handleHello, handleJoin, handleLeave, handleFlags).
+func (h *Handler) handleMessage(ctx context.Context, tenantID, userID, sessionID string, session *realtime.Session, msg *models.WSMessage) error {
 	switch msg.Type {
-	case "send_message":
-		return h.handleSendMessage(tenantID, userID, msg.Data)
+	case "send_message", "message":
+		return h.handleSendMessage(ctx, tenantID, userID, msg.Data)
 	case "ack":
 		return h.handleAck(tenantID, userID, msg.Data)
 	case "typing.start":
 		return h.handleTyping(tenantID, userID, msg.Data, "start")
 	case "typing.stop":
 		return h.handleTyping(tenantID, userID, msg.Data, "stop")
+	case "typing":
+		return h.handleTypingPayload(tenantID, userID, msg.Data)
+	case "subscribe":
+		return h.handleSubscribe(tenantID, userID, msg.Data)
+	case "sync":
+		return h.handleSync(tenantID, userID, session, msg.Data)
+	case "hello":
+		return h.handleHello(session, sessionID)
+	case "bye":
+		return h.handleBye(session)
+	case "join":
+		return h.handleJoin(tenantID, userID, session, msg.Data)
+	case "leave":
+		return h.handleLeave(session, msg.Data)
+	case "flags":
+		return h.handleFlags(tenantID, userID, session, msg.Data)
 	default:
 		slog.Warn("Unknown message type", "type", msg.Type, "tenant_id", tenantID, "user_id", userID)
 		return nil
@@ -172,39 +490,27 @@ func (h *Handler) handleMessage(tenantID, userID string, msg *models.WSMessage)
 }
 
 // handleSendMessage handles message sending via WebSocket
-func (h *Handler) handleSendMessage(tenantID, userID string, data interface{}) error {
-	msgData, ok := data.(map[string]interface{})
-	if !ok {
-		return nil
-	}
-
-	roomID, ok := msgData["room_id"].(string)
-	if !ok {
-		return nil
-	}
-
-	content, ok := msgData["content"].(string)
-	if !ok {
+func (h *Handler) handleSendMessage(ctx context.Context, tenantID, userID string, data interface{}) error {
+	payload, err := decodePayload[models.SendMessagePayload](data)
+	if err != nil || payload.RoomID == "" || payload.Content == "" {
 		return nil
 	}
 
 	req := &models.CreateMessageRequest{
-		Content: content,
-	}
-
-	if meta, ok := msgData["meta"].(string); ok {
-		req.Meta = meta
+		Content: payload.Content,
+		Meta:    payload.Meta,
 	}
 
-	message, err := h.messageSvc.SendMessage(tenantID, roomID, userID, req)
+	message, err := h.messageSvc.SendMessage(ctx, tenantID, payload.RoomID, userID, req)
 	if err != nil {
 		return err
 	}
 
-	// Broadcast to realtime subscribers
-	h.realtimeSvc.BroadcastToRoom(tenantID, roomID, map[string]interface{}{
+	// Broadcast to realtime subscribers, local and (if configured) on other
+	// nodes sharing this cluster's backplane
+	h.realtimeSvc.BroadcastMessage(tenantID, payload.RoomID, message.MessageID, int64(message.Seq), map[string]interface{}{
 		"type":       "message",
-		"room_id":    roomID,
+		"room_id":    payload.RoomID,
 		"seq":        message.Seq,
 		"message_id": message.MessageID,
 		"sender_id":  message.SenderID,
@@ -217,56 +523,273 @@ func (h *Handler) handleSendMessage(tenantID, userID string, data interface{}) e
 
 // handleAck handles acknowledgment of message delivery
 func (h *Handler) handleAck(tenantID, userID string, data interface{}) error {
-	ackData, ok := data.(map[string]interface{})
-	if !ok {
+	payload, err := decodePayload[models.AckPayload](data)
+	if err != nil || payload.RoomID == "" {
 		return nil
 	}
 
-	roomID, ok := ackData["room_id"].(string)
+	if err := h.messageSvc.UpdateLastAck(tenantID, userID, payload.RoomID, payload.Seq); err != nil {
+		return err
+	}
+
+	// Broadcast ACK to other room members, local and (if configured) on
+	// other nodes sharing this cluster's backplane
+	h.realtimeSvc.BroadcastAck(tenantID, payload.RoomID, userID, payload.Seq, map[string]interface{}{
+		"type":    "ack.received",
+		"room_id": payload.RoomID,
+		"seq":     payload.Seq,
+		"user_id": userID,
+	})
+
+	return nil
+}
+
+// handleSubscribe subscribes userID to a notification topic and replays
+// everything since from_seq (default: its last committed cursor, so a
+// reconnect picks up exactly where it left off) by pushing each entry
+// through realtimeSvc.SendToUser and committing the cursor as it goes.
+func (h *Handler) handleSubscribe(tenantID, userID string, data interface{}) error {
+	subData, ok := data.(map[string]interface{})
 	if !ok {
 		return nil
 	}
 
-	seqFloat, ok := ackData["seq"].(float64)
+	topic, ok := subData["topic"].(string)
 	if !ok {
 		return nil
 	}
-	seq := int(seqFloat)
 
-	if err := h.messageSvc.UpdateLastAck(tenantID, userID, roomID, seq); err != nil {
+	fromSeq, err := h.notifSvc.Subscribe(tenantID, topic, userID)
+	if err != nil {
 		return err
 	}
+	if seqFloat, ok := subData["from_seq"].(float64); ok {
+		fromSeq = uint64(seqFloat)
+	}
 
-	// Broadcast ACK to other room members
-	h.realtimeSvc.BroadcastToRoom(tenantID, roomID, map[string]interface{}{
-		"type":    "ack.received",
-		"room_id": roomID,
-		"seq":     seq,
-		"user_id": userID,
-	})
+	messages, err := h.notifSvc.ReadTopic(tenantID, topic, fromSeq, h.maxReplay)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		h.realtimeSvc.SendToUser(tenantID, userID, map[string]interface{}{
+			"type":    "topic.message",
+			"topic":   msg.Topic,
+			"seq":     msg.Seq,
+			"payload": msg.Payload,
+		})
+		if err := h.notifSvc.CommitCursor(tenantID, topic, userID, msg.Seq); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-// handleTyping handles typing indicators
-func (h *Handler) handleTyping(tenantID, userID string, data interface{}, action string) error {
-	typingData, ok := data.(map[string]interface{})
-	if !ok {
+// syncMaxLimit bounds how many messages handleSync will replay per room in
+// one sync frame, regardless of what the client asks for.
+const syncMaxLimit = 200
+
+// handleSync runs a Matrix-style incremental sync: for every room in the
+// client-supplied cursors (or, if none were given, every room userID is a
+// member of at its last_ack), it streams missed messages in seq order via
+// a single batched query, a sync.more frame per room if that room's result
+// was truncated, and finishes with a sync.complete frame carrying the
+// authoritative {room_id: current_seq} map the client should sync from
+// next. Delivery to this user is paused for the duration (see
+// realtimeSvc.BeginSync) so none of this interleaves with a live broadcast,
+// and every replayed message is also marked delivered on session (see
+// Session.MarkDelivered) so a broadcast already queued behind BeginSync's
+// gate is suppressed instead of being delivered a second time once the
+// gate flushes.
+func (h *Handler) handleSync(tenantID, userID string, session *realtime.Session, data interface{}) error {
+	syncData, _ := data.(map[string]interface{})
+
+	limit := syncMaxLimit
+	if l, ok := syncData["limit"].(float64); ok && l > 0 && int(l) < limit {
+		limit = int(l)
+	}
+
+	cursors := map[string]int{}
+	if raw, ok := syncData["cursors"].(map[string]interface{}); ok {
+		for roomID, v := range raw {
+			if seq, ok := v.(float64); ok {
+				cursors[roomID] = int(seq)
+			}
+		}
+	}
+	if len(cursors) == 0 {
+		var err error
+		cursors, err = h.messageSvc.GetUserRoomCursors(tenantID, userID)
+		if err != nil {
+			return err
+		}
+	}
+	if len(cursors) == 0 {
+		h.realtimeSvc.SendToUser(tenantID, userID, map[string]interface{}{
+			"type":    "sync.complete",
+			"cursors": map[string]int{},
+		})
 		return nil
 	}
 
-	roomID, ok := typingData["room_id"].(string)
-	if !ok {
+	h.realtimeSvc.BeginSync(tenantID, userID)
+	defer h.realtimeSvc.EndSync(tenantID, userID)
+
+	batches, more, err := h.messageSvc.GetMessagesBatch(tenantID, cursors, limit)
+	if err != nil {
+		return err
+	}
+
+	complete := make(map[string]int, len(cursors))
+	for roomID := range cursors {
+		for _, msg := range batches[roomID] {
+			h.realtimeSvc.SendToUser(tenantID, userID, map[string]interface{}{
+				"type":       "message",
+				"room_id":    roomID,
+				"seq":        msg.Seq,
+				"message_id": msg.MessageID,
+				"sender_id":  msg.SenderID,
+				"content":    msg.Content,
+				"created_at": msg.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
+				"replayed":   true,
+			})
+			session.MarkDelivered(roomID, msg.Seq)
+		}
+		h.realtimeSvc.SendToUser(tenantID, userID, map[string]interface{}{
+			"type":    "sync.more",
+			"room_id": roomID,
+			"more":    more[roomID],
+		})
+
+		lastSeq, err := h.messageSvc.GetLastSeq(tenantID, roomID)
+		if err != nil {
+			return err
+		}
+		complete[roomID] = lastSeq
+	}
+
+	h.realtimeSvc.SendToUser(tenantID, userID, map[string]interface{}{
+		"type":    "sync.complete",
+		"cursors": complete,
+	})
+
+	return nil
+}
+
+// handleTyping handles typing indicators. Unlike message/ack delivery,
+// typing is only fanned out to sessions that have explicitly joined the
+// room (see realtimeSvc.BroadcastToJoined), since it's ephemeral and a
+// member who isn't currently looking at the room has no use for it.
+func (h *Handler) handleTyping(tenantID, userID string, data interface{}, action string) error {
+	payload, err := decodePayload[models.TypingPayload](data)
+	if err != nil || payload.RoomID == "" {
 		return nil
 	}
 
-	// Broadcast typing indicator to room members
-	h.realtimeSvc.BroadcastToRoom(tenantID, roomID, map[string]interface{}{
+	h.realtimeSvc.BroadcastToJoined(tenantID, payload.RoomID, map[string]interface{}{
 		"type":    "typing",
-		"room_id": roomID,
+		"room_id": payload.RoomID,
 		"user_id": userID,
 		"action":  action,
 	})
 
 	return nil
-}
\ No newline at end of file
+}
+
+// handleTypingPayload handles the unified "typing" WSMessage, whose action
+// (start/stop) travels inline in the payload rather than in msg.Type.
+func (h *Handler) handleTypingPayload(tenantID, userID string, data interface{}) error {
+	payload, err := decodePayload[models.TypingActionPayload](data)
+	if err != nil || payload.RoomID == "" {
+		return nil
+	}
+	return h.handleTyping(tenantID, userID, map[string]interface{}{"room_id": payload.RoomID}, payload.Action)
+}
+
+// handleHello acknowledges a client-initiated "hello" frame. The actual
+// authentication and session-id issuance already happened in
+// negotiateSession as part of the upgrade handshake (see
+// HandleConnection); hello simply confirms it on a protocol level the
+// client can rely on for resuming via wssession.
+func (h *Handler) handleHello(session *realtime.Session, sessionID string) error {
+	return session.SendMessage(map[string]interface{}{
+		"type":       "hello.ack",
+		"session_id": sessionID,
+	})
+}
+
+// handleBye marks the session as disconnecting (so flags shared with a
+// joined room's other participants reflect it immediately, ahead of the
+// connection actually closing) and acknowledges the frame.
+func (h *Handler) handleBye(session *realtime.Session) error {
+	session.SetFlags(session.Flags() | realtime.FlagDisconnected)
+	return session.SendMessage(map[string]interface{}{"type": "bye.ack"})
+}
+
+// handleJoin subscribes session to live fan-out for a room (see
+// realtime.Session.JoinRoom) and announces the join to the room's other
+// joined sessions so they can update presence/participant lists.
+func (h *Handler) handleJoin(tenantID, userID string, session *realtime.Session, data interface{}) error {
+	payload, err := decodePayload[models.JoinPayload](data)
+	if err != nil || payload.RoomID == "" {
+		return nil
+	}
+
+	session.JoinRoom(payload.RoomID)
+	h.realtimeSvc.BroadcastToJoined(tenantID, payload.RoomID, map[string]interface{}{
+		"type":    "room.joined",
+		"room_id": payload.RoomID,
+		"user_id": userID,
+	})
+
+	return nil
+}
+
+// handleLeave unsubscribes session from a room's live fan-out, the inverse
+// of handleJoin.
+func (h *Handler) handleLeave(session *realtime.Session, data interface{}) error {
+	payload, err := decodePayload[models.LeavePayload](data)
+	if err != nil || payload.RoomID == "" {
+		return nil
+	}
+
+	session.LeaveRoom(payload.RoomID)
+	return nil
+}
+
+// handleFlags updates session's advertised call-participation flags and
+// announces the change to every room it has joined, so other participants
+// see updated in-call/audio/video state without polling.
+func (h *Handler) handleFlags(tenantID, userID string, session *realtime.Session, data interface{}) error {
+	payload, err := decodePayload[models.FlagsPayload](data)
+	if err != nil {
+		return nil
+	}
+
+	var flags realtime.Flag
+	if payload.InCall {
+		flags |= realtime.FlagInCall
+	}
+	if payload.WithAudio {
+		flags |= realtime.FlagWithAudio
+	}
+	if payload.WithVideo {
+		flags |= realtime.FlagWithVideo
+	}
+	session.SetFlags(flags)
+
+	for _, roomID := range session.JoinedRooms() {
+		h.realtimeSvc.BroadcastToJoined(tenantID, roomID, map[string]interface{}{
+			"type":       "flags.update",
+			"room_id":    roomID,
+			"user_id":    userID,
+			"in_call":    payload.InCall,
+			"with_audio": payload.WithAudio,
+			"with_video": payload.WithVideo,
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+// Package metrics holds the process-wide Prometheus collectors for GET
+// /metrics, and the small helpers call sites use to record against them
+// (an HTTP middleware and a DB query timer) so instrumentation doesn't leak
+// prometheus types into every package that wants to report something.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// WSConnections is the number of currently registered WebSocket
+	// connections, by tenant; see realtime.Service.RegisterConnection and
+	// UnregisterConnection.
+	WSConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chatapi_ws_connections",
+		Help: "Currently registered WebSocket connections, by tenant.",
+	}, []string{"tenant"})
+
+	// WSMessagesSent counts every frame enqueued to a session's writer
+	// pump, by tenant and the payload's "type" field (e.g. "message.new",
+	// "presence.update", "typing").
+	WSMessagesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chatapi_ws_messages_sent_total",
+		Help: "WebSocket messages enqueued for delivery, by tenant and message type.",
+	}, []string{"tenant", "type"})
+
+	// BroadcastQueueDepth is sampled from len(realtime.Service.broadcastCh)
+	// whenever a message enters or leaves it, so a filling queue shows up
+	// before it actually starts dropping broadcasts.
+	BroadcastQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chatapi_broadcast_queue_depth",
+		Help: "Pending messages on the realtime service's broadcast channel.",
+	})
+
+	// BroadcastDropped counts a BroadcastToRoom call that found the
+	// broadcast channel full; see realtime.Service.broadcastSequenced.
+	BroadcastDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chatapi_broadcast_dropped_total",
+		Help: "Broadcasts dropped because the broadcast channel was full.",
+	})
+
+	// HTTPRequestDuration is recorded by InstrumentHTTP for every request,
+	// keyed by the http.ServeMux pattern it matched and its response code.
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "chatapi_http_request_duration_seconds",
+		Help: "REST request latency, by route and status code.",
+	}, []string{"route", "code"})
+
+	// DBQueryDuration is recorded by ObserveDBQuery around hot SQLite read
+	// paths (e.g. realtime's room member lookups), by query name.
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "chatapi_db_query_duration_seconds",
+		Help: "SQLite query latency for instrumented read paths, by query name.",
+	}, []string{"query"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		WSConnections,
+		WSMessagesSent,
+		BroadcastQueueDepth,
+		BroadcastDropped,
+		HTTPRequestDuration,
+		DBQueryDuration,
+	)
+}
+
+// Handler exposes every registered collector in the Prometheus exposition
+// format for GET /metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// statusRecorder captures the status code a wrapped http.ResponseWriter was
+// written with, defaulting to 200 for a handler that never calls
+// WriteHeader explicitly (the same assumption net/http itself makes).
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// InstrumentHTTP wraps next so every request through it is recorded on
+// HTTPRequestDuration. It must wrap the top-level mux (not an individual
+// route) so that by the time it reads r.Pattern after next.ServeHTTP
+// returns, http.ServeMux has already set it to the matched route - the same
+// assumption Handler.AuthMiddleware makes for rate-limit bucketing.
+func InstrumentHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		HTTPRequestDuration.WithLabelValues(route, strconv.Itoa(rec.status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// ObserveDBQuery runs fn and records its duration on DBQueryDuration under
+// query, the label a dashboard groups by (e.g. "get_room_members").
+func ObserveDBQuery(query string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	DBQueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+	return err
+}
@@ -1,25 +1,29 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // Tenant represents a tenant in the system
 type Tenant struct {
-	TenantID string    `json:"tenant_id" db:"tenant_id"`
-	APIKey   string    `json:"-" db:"api_key"` // Never serialize API key
-	Name     string    `json:"name,omitempty" db:"name"`
-	Config   string    `json:"-" db:"config"` // JSON config, not serialized
+	TenantID  string    `json:"tenant_id" db:"tenant_id"`
+	APIKey    string    `json:"-" db:"api_key"` // Never serialize API key
+	Name      string    `json:"name,omitempty" db:"name"`
+	Config    string    `json:"-" db:"config"` // JSON config, not serialized
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 }
 
 // Room represents a chat room
 type Room struct {
-	RoomID    string    `json:"room_id" db:"room_id"`
-	TenantID  string    `json:"tenant_id" db:"tenant_id"`
-	Type      string    `json:"type" db:"type"` // "dm", "group", "channel"
-	UniqueKey string    `json:"-" db:"unique_key"` // For DMs
-	Name      string    `json:"name,omitempty" db:"name"`
-	LastSeq   int       `json:"last_seq" db:"last_seq"`
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	RoomID        string     `json:"room_id" db:"room_id"`
+	TenantID      string     `json:"tenant_id" db:"tenant_id"`
+	Type          string     `json:"type" db:"type"`    // "dm", "group", "channel"
+	UniqueKey     string     `json:"-" db:"unique_key"` // For DMs
+	Name          string     `json:"name,omitempty" db:"name"`
+	LastSeq       int        `json:"last_seq" db:"last_seq"`
+	LastMessageAt *time.Time `json:"last_message_at,omitempty" db:"last_message_at"` // Ordering metadata for sliding sync
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
 }
 
 // RoomMember represents a user's membership in a room
@@ -41,6 +45,10 @@ type Message struct {
 	Content    string    `json:"content" db:"content"`
 	Meta       string    `json:"meta,omitempty" db:"meta"` // JSON metadata
 	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	// EventID is a content hash that's stable across servers, set on every
+	// message so federation peers can deduplicate a message relayed to them
+	// more than once; see federation.Service.SendMessageEvent.
+	EventID string `json:"event_id,omitempty" db:"event_id"`
 }
 
 // DeliveryState tracks per-user per-room delivery state
@@ -54,27 +62,36 @@ type DeliveryState struct {
 
 // UndeliveredMessage represents a message that hasn't been delivered yet
 type UndeliveredMessage struct {
-	ID           int       `json:"id" db:"id"`
-	TenantID     string    `json:"tenant_id" db:"tenant_id"`
-	UserID       string    `json:"user_id" db:"user_id"`
-	ChatroomID   string    `json:"chatroom_id" db:"chatroom_id"`
-	MessageID    string    `json:"message_id" db:"message_id"`
-	Seq          int       `json:"seq" db:"seq"`
-	Attempts     int       `json:"attempts" db:"attempts"`
-	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	ID            int        `json:"id" db:"id"`
+	TenantID      string     `json:"tenant_id" db:"tenant_id"`
+	UserID        string     `json:"user_id" db:"user_id"`
+	ChatroomID    string     `json:"chatroom_id" db:"chatroom_id"`
+	MessageID     string     `json:"message_id" db:"message_id"`
+	Seq           int        `json:"seq" db:"seq"`
+	Attempts      int        `json:"attempts" db:"attempts"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
 	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty" db:"last_attempt_at"`
 }
 
 // Notification represents a durable notification
 type Notification struct {
-	NotificationID string    `json:"notification_id" db:"notification_id"`
-	TenantID       string    `json:"tenant_id" db:"tenant_id"`
-	Topic          string    `json:"topic" db:"topic"`
-	Payload        string    `json:"payload" db:"payload"` // JSON payload
-	CreatedAt      time.Time `json:"created_at" db:"created_at"`
-	Status         string    `json:"status" db:"status"` // pending, processing, delivered, failed, dead
-	Attempts       int       `json:"attempts" db:"attempts"`
+	NotificationID string     `json:"notification_id" db:"notification_id"`
+	TenantID       string     `json:"tenant_id" db:"tenant_id"`
+	Topic          string     `json:"topic" db:"topic"`
+	Payload        string     `json:"payload" db:"payload"` // JSON payload
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	Status         string     `json:"status" db:"status"` // pending, processing, delivered, failed, dead
+	Attempts       int        `json:"attempts" db:"attempts"`
 	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty" db:"last_attempt_at"`
+	TopicSeq       int64      `json:"topic_seq" db:"topic_seq"` // position in this topic's topiclog WAL
+}
+
+// TopicMessage is a single entry read back from a topic's topiclog WAL, for
+// HTTP catch-up and WebSocket subscribe/replay.
+type TopicMessage struct {
+	Topic   string          `json:"topic"`
+	Seq     uint64          `json:"seq"`
+	Payload json.RawMessage `json:"payload"`
 }
 
 // NotificationSubscription represents a subscription to notification topics
@@ -88,6 +105,19 @@ type NotificationSubscription struct {
 	CreatedAt    time.Time `json:"created_at" db:"created_at"`
 }
 
+// DeadLetterEntry represents a message, notification, or webhook delivery
+// that exhausted its retries and is parked for operator inspection/requeue
+type DeadLetterEntry struct {
+	ID        int       `json:"id" db:"id"`
+	TenantID  string    `json:"tenant_id" db:"tenant_id"`
+	Kind      string    `json:"kind" db:"kind"` // "message", "notification", "webhook_delivery", "federation_send"
+	RefID     string    `json:"ref_id" db:"ref_id"`
+	Payload   string    `json:"payload" db:"payload"`
+	LastError string    `json:"last_error,omitempty" db:"last_error"`
+	Attempts  int       `json:"attempts" db:"attempts"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
 // API request/response types
 
 // CreateRoomRequest represents a request to create a room
@@ -111,16 +141,16 @@ type AckRequest struct {
 
 // CreateNotificationRequest represents a request to create a notification
 type CreateNotificationRequest struct {
-	Topic    string                 `json:"topic"`
-	Payload  map[string]interface{} `json:"payload"`
-	Targets  NotificationTargets    `json:"targets"`
+	Topic   string                 `json:"topic"`
+	Payload map[string]interface{} `json:"payload"`
+	Targets NotificationTargets    `json:"targets"`
 }
 
 // NotificationTargets specifies who should receive a notification
 type NotificationTargets struct {
-	UserIDs           []string `json:"user_ids,omitempty"`
-	RoomID            string   `json:"room_id,omitempty"`
-	TopicSubscribers  bool     `json:"topic_subscribers,omitempty"`
+	UserIDs          []string `json:"user_ids,omitempty"`
+	RoomID           string   `json:"room_id,omitempty"`
+	TopicSubscribers bool     `json:"topic_subscribers,omitempty"`
 }
 
 // WebSocket message types
@@ -131,21 +161,68 @@ type WSMessage struct {
 	Data interface{} `json:"data,omitempty"`
 }
 
-// WSMessageSend represents a send message command
-type WSMessageSend struct {
+// SendMessagePayload is the typed Data payload for a "send_message"
+// WSMessage, decoded the same way regardless of which wire codec
+// negotiated the connection (see ws.decodePayload).
+type SendMessagePayload struct {
 	RoomID  string `json:"room_id"`
 	Content string `json:"content"`
 	Meta    string `json:"meta,omitempty"`
 }
 
-// WSAck represents an acknowledgment
-type WSAck struct {
+// AckPayload is the typed Data payload for an "ack" WSMessage.
+type AckPayload struct {
 	RoomID string `json:"room_id"`
 	Seq    int    `json:"seq"`
 }
 
+// TypingPayload is the typed Data payload for a "typing.start"/"typing.stop"
+// WSMessage.
+type TypingPayload struct {
+	RoomID string `json:"room_id"`
+}
+
+// TypingActionPayload is the typed Data payload for the unified "typing"
+// WSMessage, which carries its start/stop action inline instead of in the
+// message type (compare TypingPayload, used by the older
+// "typing.start"/"typing.stop" pair).
+type TypingActionPayload struct {
+	RoomID string `json:"room_id"`
+	Action string `json:"action"` // "start" or "stop"
+}
+
+// JoinPayload is the typed Data payload for a "join" WSMessage, subscribing
+// the session to live fan-out for room_id (see realtime.Session.JoinRoom).
+type JoinPayload struct {
+	RoomID string `json:"room_id"`
+}
+
+// LeavePayload is the typed Data payload for a "leave" WSMessage, the
+// inverse of JoinPayload.
+type LeavePayload struct {
+	RoomID string `json:"room_id"`
+}
+
+// FlagsPayload is the typed Data payload for a "flags" WSMessage, by which
+// a session advertises its current call-participation state (Spreed-style
+// in_call/with_audio/with_video flags) to other sessions joined to the
+// same rooms.
+type FlagsPayload struct {
+	InCall    bool `json:"in_call"`
+	WithAudio bool `json:"with_audio"`
+	WithVideo bool `json:"with_video"`
+}
+
+// WSResumeRequest is sent by a reconnecting client as the first frame on a
+// new connection, asking to resume session_id and replay, per room, any
+// messages with seq greater than the room's entry in last_seq.
+type WSResumeRequest struct {
+	SessionID string         `json:"session_id"`
+	LastSeq   map[string]int `json:"last_seq"`
+}
+
 // WSTyping represents a typing indicator
 type WSTyping struct {
 	RoomID string `json:"room_id"`
 	Action string `json:"action"` // "start" or "stop"
-}
\ No newline at end of file
+}
@@ -0,0 +1,75 @@
+// Package netutil holds small HTTP/network helpers shared across the REST
+// and WebSocket handlers that don't belong to either one specifically.
+package netutil
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientIP determines the real client address for r. chatapi is typically
+// deployed behind a reverse proxy, so the direct socket peer (RemoteAddr)
+// is usually the proxy, not the client: ClientIP trusts X-Real-IP first
+// (set by a single well-behaved edge proxy), then walks X-Forwarded-For
+// from right to left - the order hops append to it - skipping any address
+// that falls inside trustedProxies, and returns the first one that
+// doesn't. If every parseable hop in X-Forwarded-For is trusted, it returns
+// the leftmost (oldest) of them; if the header is absent or none of its
+// entries parses, it falls back to RemoteAddr. The zero netip.Addr is
+// returned if none of the above yields anything parseable.
+func ClientIP(r *http.Request, trustedProxies []netip.Prefix) netip.Addr {
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		if addr, ok := parseAddr(realIP); ok {
+			return addr
+		}
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		var oldestParsed netip.Addr
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, ok := parseAddr(strings.TrimSpace(hops[i]))
+			if !ok {
+				continue
+			}
+			oldestParsed = addr
+			if !isTrusted(addr, trustedProxies) {
+				return addr
+			}
+		}
+		// Every hop was inside trustedProxies (or none parsed) - oldestParsed
+		// is the leftmost parseable entry, i.e. whatever the client (or the
+		// first proxy in the chain) originally set, which is the closest
+		// thing to a real client address left.
+		if oldestParsed.IsValid() {
+			return oldestParsed
+		}
+	}
+
+	if addr, ok := parseAddr(r.RemoteAddr); ok {
+		return addr
+	}
+	return netip.Addr{}
+}
+
+// parseAddr parses s as a netip.Addr, stripping a ":port" suffix first if
+// present (RemoteAddr and most proxy-appended entries carry one; X-Real-IP
+// and bare X-Forwarded-For entries usually don't).
+func parseAddr(s string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(s)
+	return addr, err == nil
+}
+
+func isTrusted(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
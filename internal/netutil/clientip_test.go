@@ -0,0 +1,98 @@
+package netutil
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func mustPrefix(t *testing.T, s string) netip.Prefix {
+	t.Helper()
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		t.Fatalf("ParsePrefix(%q): %v", s, err)
+	}
+	return p
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{mustPrefix(t, "10.0.0.0/8")}
+
+	tests := []struct {
+		name           string
+		realIP         string
+		forwardedFor   string
+		remoteAddr     string
+		trustedProxies []netip.Prefix
+		want           string
+	}{
+		{
+			name:   "X-Real-IP wins outright",
+			realIP: "203.0.113.5",
+			want:   "203.0.113.5",
+		},
+		{
+			name:           "rightmost untrusted hop in X-Forwarded-For",
+			forwardedFor:   "203.0.113.5, 10.0.0.1",
+			trustedProxies: trusted,
+			remoteAddr:     "10.0.0.1:12345",
+			want:           "203.0.113.5",
+		},
+		{
+			name:           "walks past multiple trusted hops",
+			forwardedFor:   "203.0.113.5, 10.0.0.2, 10.0.0.1",
+			trustedProxies: trusted,
+			remoteAddr:     "10.0.0.1:12345",
+			want:           "203.0.113.5",
+		},
+		{
+			// The actual proxy chain is empty (RemoteAddr itself is
+			// untrusted), but the header carries an extra spoofed hop
+			// prepended by the client to masquerade as a longer trusted
+			// chain than really exists. The real peer address still
+			// appears at the rightmost position, so it must win.
+			name:           "spoofed X-Forwarded-For longer than the real trusted chain",
+			forwardedFor:   "198.51.100.9, 203.0.113.5",
+			trustedProxies: trusted,
+			remoteAddr:     "203.0.113.5:12345",
+			want:           "203.0.113.5",
+		},
+		{
+			name:           "every hop trusted falls back to the leftmost (oldest) entry",
+			forwardedFor:   "10.0.0.3, 10.0.0.2, 10.0.0.1",
+			trustedProxies: trusted,
+			remoteAddr:     "10.0.0.1:12345",
+			want:           "10.0.0.3",
+		},
+		{
+			name:       "no headers falls back to RemoteAddr",
+			remoteAddr: "203.0.113.9:54321",
+			want:       "203.0.113.9",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{Header: http.Header{}, RemoteAddr: tt.remoteAddr}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+
+			got := ClientIP(r, tt.trustedProxies)
+			if got.String() != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIPUnparseable(t *testing.T) {
+	r := &http.Request{Header: http.Header{}, RemoteAddr: "not-an-address"}
+	got := ClientIP(r, nil)
+	if got.IsValid() {
+		t.Errorf("ClientIP() = %v, want zero value for an unparseable RemoteAddr", got)
+	}
+}
@@ -0,0 +1,25 @@
+package netutil
+
+import (
+	"context"
+	"net/netip"
+)
+
+// clientIPKey is the context key ClientIP's result is stored under, so it
+// survives the trip from the HTTP/WebSocket layer down into service
+// methods (e.g. message.Service.SendMessage's audit log) without every
+// function in between needing its own clientIP parameter.
+type clientIPKey struct{}
+
+// WithClientIP returns a copy of ctx carrying addr, retrievable later with
+// ClientIPFromContext.
+func WithClientIP(ctx context.Context, addr netip.Addr) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, addr)
+}
+
+// ClientIPFromContext returns the address stored by WithClientIP, or the
+// zero netip.Addr and false if ctx doesn't carry one.
+func ClientIPFromContext(ctx context.Context) (netip.Addr, bool) {
+	addr, ok := ctx.Value(clientIPKey{}).(netip.Addr)
+	return addr, ok
+}
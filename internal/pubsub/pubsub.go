@@ -0,0 +1,95 @@
+// Package pubsub is an in-process event bus used to fan out row-level
+// changes (new messages, notifications, room membership) to subscribers
+// such as the delivery worker or a connected WebSocket client, without
+// requiring them to poll the database.
+package pubsub
+
+import "sync"
+
+// Event is a single notification delivered to subscribers of a topic.
+type Event struct {
+	Topic    string
+	TenantID string
+	Payload  interface{}
+}
+
+// wildcardTenant is the tenant key used by subscribers that want events for
+// every tenant on a topic, analogous to listening on a channel name rather
+// than a per-tenant queue.
+const wildcardTenant = ""
+
+// Bus is an in-process publish/subscribe hub, similar in spirit to
+// pq.NewListener but without a network round trip: Publish fans an event out
+// to every subscriber registered for that tenant/topic pair, plus any
+// wildcard subscribers registered with an empty tenantID.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[string]map[chan Event]struct{}
+}
+
+// NewBus creates a new, empty event bus.
+func NewBus() *Bus {
+	return &Bus{subs: make(map[string]map[chan Event]struct{})}
+}
+
+func subKey(tenantID, topic string) string {
+	return tenantID + "|" + topic
+}
+
+// Subscribe registers a subscriber for a tenant/topic pair and returns a
+// receive-only channel of matching events plus a cancel function. Pass an
+// empty tenantID to receive events for that topic across all tenants. The
+// cancel function must be called when the subscriber is done to release the
+// channel; it is safe to call more than once.
+func (b *Bus) Subscribe(tenantID, topic string) (<-chan Event, func()) {
+	ch := make(chan Event, 16)
+	key := subKey(tenantID, topic)
+
+	b.mu.Lock()
+	if b.subs[key] == nil {
+		b.subs[key] = make(map[chan Event]struct{})
+	}
+	b.subs[key][ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs[key], ch)
+			if len(b.subs[key]) == 0 {
+				delete(b.subs, key)
+			}
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+
+	return ch, cancel
+}
+
+// Publish delivers an event to every subscriber of tenantID/topic as well as
+// wildcard subscribers of topic. Delivery is non-blocking: a subscriber whose
+// buffer is full drops the event rather than stalling the publisher.
+func (b *Bus) Publish(tenantID, topic string, payload interface{}) {
+	event := Event{Topic: topic, TenantID: tenantID, Payload: payload}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch := range b.subs[subKey(tenantID, topic)] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+
+	if tenantID != wildcardTenant {
+		for ch := range b.subs[subKey(wildcardTenant, topic)] {
+			select {
+			case ch <- event:
+			default:
+			}
+		}
+	}
+}
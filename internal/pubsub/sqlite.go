@@ -0,0 +1,64 @@
+package pubsub
+
+import (
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// TableEvent is the coarse, best-effort notification delivered from the
+// SQLite update hook. It carries only what RegisterUpdateHook gives us (the
+// table and rowid of the changed row), as a belt-and-suspenders complement to
+// the richer, typed events services publish explicitly after a commit.
+type TableEvent struct {
+	Op    string
+	Table string
+	RowID int64
+}
+
+// TableTopic returns the wildcard topic a TableEvent for table is published
+// under, e.g. Subscribe("", pubsub.TableTopic("messages")).
+func TableTopic(table string) string {
+	return "db:" + table
+}
+
+var driverCounter int64
+
+// RegisterSQLiteDriver registers a uniquely named variant of the sqlite3
+// driver whose connections forward every INSERT/UPDATE/DELETE to bus via
+// SQLite's update hook, and returns the driver name to pass to sql.Open.
+// Each call registers a distinct driver, so it is safe to call once per *DB
+// being opened.
+func RegisterSQLiteDriver(bus *Bus) string {
+	name := fmt.Sprintf("sqlite3_pubsub_%d", atomic.AddInt64(&driverCounter, 1))
+
+	sql.Register(name, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			conn.RegisterUpdateHook(func(op int, _ string, table string, rowID int64) {
+				bus.Publish(wildcardTenant, TableTopic(table), TableEvent{
+					Op:    updateHookOpName(op),
+					Table: table,
+					RowID: rowID,
+				})
+			})
+			return nil
+		},
+	})
+
+	return name
+}
+
+func updateHookOpName(op int) string {
+	switch op {
+	case sqlite3.SQLITE_INSERT:
+		return "insert"
+	case sqlite3.SQLITE_UPDATE:
+		return "update"
+	case sqlite3.SQLITE_DELETE:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,208 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// RouteLimit configures the capacity and refill rate of a single bucket.
+type RouteLimit struct {
+	Capacity   float64
+	RefillRate float64 // tokens per second
+}
+
+// Decision is the outcome of a Limiter.Check call. Callers use it to set the
+// X-RateLimit-* response headers on every request (allowed or not) and
+// Retry-After when the request is rejected.
+type Decision struct {
+	Allowed   bool
+	Bucket    string // e.g. "route:POST /rooms/{room_id}/messages", "tenant", "global"
+	Limit     int
+	Remaining int
+	ResetAt   time.Time
+}
+
+// trackedBucket pairs a TokenBucket with the time it was last touched, so
+// Limiter.GC can evict buckets nobody has used in a while.
+type trackedBucket struct {
+	bucket   *TokenBucket
+	lastUsed time.Time
+}
+
+// Limiter layers token buckets, modeled on the Discord gateway's rate limit
+// buckets: a per-(tenant, route) bucket, a per-tenant bucket covering all of
+// that tenant's routes, an optional per-(tenant, clientIP) bucket (see
+// CheckWithIPLimit), and a single process-wide bucket. A request must have
+// capacity in every tier it's checked against to be allowed, so one hot
+// route or one abusive IP can't starve the rest of a tenant's traffic, and
+// one noisy tenant can't starve everyone else.
+type Limiter struct {
+	mu sync.Mutex
+
+	routeLimits  map[string]RouteLimit // routeKey -> limit
+	defaultRoute RouteLimit
+	tenantLimit  RouteLimit
+	globalLimit  RouteLimit
+
+	routeBuckets  map[string]*trackedBucket // key: tenantID+"\x00"+routeKey
+	tenantBuckets map[string]*trackedBucket // key: tenantID
+	ipBuckets     map[string]*trackedBucket // key: tenantID+"\x00"+clientIP
+	global        *trackedBucket
+}
+
+// NewLimiter creates a Limiter. routeLimits maps a routeKey (method + space
+// + templated path, e.g. "POST /rooms/{room_id}/messages") to its bucket
+// config; routes with no entry fall back to defaultRoute. tenantLimit caps
+// a single tenant's combined traffic across all routes; globalLimit caps
+// the whole process.
+func NewLimiter(routeLimits map[string]RouteLimit, defaultRoute, tenantLimit, globalLimit RouteLimit) *Limiter {
+	return &Limiter{
+		routeLimits:   routeLimits,
+		defaultRoute:  defaultRoute,
+		tenantLimit:   tenantLimit,
+		globalLimit:   globalLimit,
+		routeBuckets:  make(map[string]*trackedBucket),
+		tenantBuckets: make(map[string]*trackedBucket),
+		ipBuckets:     make(map[string]*trackedBucket),
+		global:        &trackedBucket{bucket: NewTokenBucket(globalLimit.Capacity, globalLimit.RefillRate)},
+	}
+}
+
+// UpdateLimits swaps in new bucket capacities/refill rates. Existing buckets
+// are reconfigured in place on their next Check rather than recreated, so a
+// tenant mid-burst doesn't get a free refill just because the config
+// changed. Safe to call concurrently with Check.
+func (l *Limiter) UpdateLimits(routeLimits map[string]RouteLimit, defaultRoute, tenantLimit, globalLimit RouteLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.routeLimits = routeLimits
+	l.defaultRoute = defaultRoute
+	l.tenantLimit = tenantLimit
+	l.globalLimit = globalLimit
+}
+
+// Check consumes one token from routeKey's bucket, tenantID's overall
+// bucket (sized from the Limiter's default tenant config), and the
+// process-wide bucket. See CheckWithTenantLimit to size the tenant bucket
+// per-tenant instead.
+func (l *Limiter) Check(tenantID, routeKey string) Decision {
+	l.mu.Lock()
+	tenantLimit := l.tenantLimit
+	l.mu.Unlock()
+	return l.CheckWithTenantLimit(tenantID, routeKey, tenantLimit)
+}
+
+// CheckWithTenantLimit is Check, but sizes tenantID's overall bucket from
+// tenantLimit instead of the Limiter's default - callers that store a
+// per-tenant rate limit override (e.g. in TenantConfig) pass it here. If a
+// later bucket in the chain rejects the request, tokens already taken from
+// earlier buckets are refunded so a request that's ultimately denied
+// doesn't cost the tenant or route anything.
+func (l *Limiter) CheckWithTenantLimit(tenantID, routeKey string, tenantLimit RouteLimit) Decision {
+	return l.check(tenantID, routeKey, "", tenantLimit, RouteLimit{})
+}
+
+// CheckWithIPLimit is CheckWithTenantLimit, but also consults a fourth
+// bucket scoped to (tenantID, clientIP), sized from ipLimit, between the
+// tenant and global tiers - so one abusive IP address can be throttled
+// without starving the rest of tenantID's traffic. clientIP is opaque to
+// the limiter (callers pass a netip.Addr rendered with String()); pass ""
+// to skip this tier entirely, equivalent to calling CheckWithTenantLimit.
+func (l *Limiter) CheckWithIPLimit(tenantID, routeKey, clientIP string, tenantLimit, ipLimit RouteLimit) Decision {
+	return l.check(tenantID, routeKey, clientIP, tenantLimit, ipLimit)
+}
+
+func (l *Limiter) check(tenantID, routeKey, clientIP string, tenantLimit, ipLimit RouteLimit) Decision {
+	l.mu.Lock()
+	routeLimit, ok := l.routeLimits[routeKey]
+	if !ok {
+		routeLimit = l.defaultRoute
+	}
+	globalLimit := l.globalLimit
+
+	route := l.getOrCreate(l.routeBuckets, tenantID+"\x00"+routeKey, routeLimit)
+	tenant := l.getOrCreate(l.tenantBuckets, tenantID, tenantLimit)
+	var ip *TokenBucket
+	if clientIP != "" {
+		ip = l.getOrCreate(l.ipBuckets, tenantID+"\x00"+clientIP, ipLimit)
+	}
+	global := l.global.bucket
+	l.global.lastUsed = time.Now()
+	global.Reconfigure(globalLimit.Capacity, globalLimit.RefillRate)
+	l.mu.Unlock()
+
+	if !route.TryConsume() {
+		return decisionFor(false, "route:"+routeKey, routeLimit, route)
+	}
+	if !tenant.TryConsume() {
+		route.Refund()
+		return decisionFor(false, "tenant", tenantLimit, tenant)
+	}
+	if ip != nil && !ip.TryConsume() {
+		route.Refund()
+		tenant.Refund()
+		return decisionFor(false, "ip", ipLimit, ip)
+	}
+	if !global.TryConsume() {
+		route.Refund()
+		tenant.Refund()
+		if ip != nil {
+			ip.Refund()
+		}
+		return decisionFor(false, "global", globalLimit, global)
+	}
+
+	return decisionFor(true, "route:"+routeKey, routeLimit, route)
+}
+
+// getOrCreate returns the bucket for key, creating it from limit if it
+// doesn't exist yet, and reconfiguring it to limit either way. Callers must
+// hold l.mu.
+func (l *Limiter) getOrCreate(m map[string]*trackedBucket, key string, limit RouteLimit) *TokenBucket {
+	tb, ok := m[key]
+	if !ok {
+		tb = &trackedBucket{bucket: NewTokenBucket(limit.Capacity, limit.RefillRate)}
+		m[key] = tb
+	}
+	tb.lastUsed = time.Now()
+	tb.bucket.Reconfigure(limit.Capacity, limit.RefillRate)
+	return tb.bucket
+}
+
+// GC evicts route and tenant buckets that haven't been touched in idleTTL,
+// keeping the bucket maps from growing without bound as tenants and routes
+// come and go. The process-wide global bucket is never evicted.
+func (l *Limiter) GC(idleTTL time.Duration) {
+	cutoff := time.Now().Add(-idleTTL)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, tb := range l.routeBuckets {
+		if tb.lastUsed.Before(cutoff) {
+			delete(l.routeBuckets, key)
+		}
+	}
+	for key, tb := range l.tenantBuckets {
+		if tb.lastUsed.Before(cutoff) {
+			delete(l.tenantBuckets, key)
+		}
+	}
+	for key, tb := range l.ipBuckets {
+		if tb.lastUsed.Before(cutoff) {
+			delete(l.ipBuckets, key)
+		}
+	}
+}
+
+// decisionFor builds a Decision from a bucket's state after a Check attempt.
+func decisionFor(allowed bool, bucket string, limit RouteLimit, tb *TokenBucket) Decision {
+	remaining, resetAt := tb.Status(limit)
+	return Decision{
+		Allowed:   allowed,
+		Bucket:    bucket,
+		Limit:     int(limit.Capacity),
+		Remaining: remaining,
+		ResetAt:   resetAt,
+	}
+}
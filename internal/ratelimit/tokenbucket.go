@@ -1,3 +1,7 @@
+// Package ratelimit implements token-bucket rate limiting, layered the way
+// Discord's gateway does it: per-route buckets, a per-tenant ceiling, and a
+// process-wide bucket, checked together by Limiter so a hot route or a
+// single noisy tenant can't starve everyone else. See limiter.go.
 package ratelimit
 
 import (
@@ -5,16 +9,16 @@ import (
 	"time"
 )
 
-// TokenBucket implements a token bucket rate limiter
+// TokenBucket implements a token bucket rate limiter.
 type TokenBucket struct {
-	mu        sync.Mutex
-	tokens    float64
-	capacity  float64
+	mu         sync.Mutex
+	tokens     float64
+	capacity   float64
 	refillRate float64 // tokens per second
 	lastRefill time.Time
 }
 
-// NewTokenBucket creates a new token bucket rate limiter
+// NewTokenBucket creates a new token bucket rate limiter, starting full.
 func NewTokenBucket(capacity float64, refillRate float64) *TokenBucket {
 	return &TokenBucket{
 		tokens:     capacity,
@@ -24,71 +28,80 @@ func NewTokenBucket(capacity float64, refillRate float64) *TokenBucket {
 	}
 }
 
-// Allow checks if a request should be allowed and consumes a token if so
-func (tb *TokenBucket) Allow() bool {
-	tb.mu.Lock()
-	defer tb.mu.Unlock()
-
+// refill tops up tokens based on elapsed time since the last refill. Callers
+// must hold tb.mu.
+func (tb *TokenBucket) refill() {
 	now := time.Now()
 	elapsed := now.Sub(tb.lastRefill)
 	tb.lastRefill = now
 
-	// Refill tokens based on elapsed time
 	tb.tokens += elapsed.Seconds() * tb.refillRate
 	if tb.tokens > tb.capacity {
 		tb.tokens = tb.capacity
 	}
+}
+
+// TryConsume reports whether a request should be allowed and, if so,
+// consumes a token.
+func (tb *TokenBucket) TryConsume() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
 
-	// Check if we have enough tokens
+	tb.refill()
 	if tb.tokens >= 1.0 {
 		tb.tokens -= 1.0
 		return true
 	}
-
 	return false
 }
 
-// Tokens returns the current number of tokens (for testing/debugging)
-func (tb *TokenBucket) Tokens() float64 {
+// Refund returns a previously consumed token, capped at capacity. Used to
+// undo a TryConsume when a later bucket in the same check rejects the
+// request.
+func (tb *TokenBucket) Refund() {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
-	return tb.tokens
-}
 
-// RateLimiter manages rate limiting per tenant
-type RateLimiter struct {
-	mu      sync.RWMutex
-	buckets map[string]*TokenBucket
-}
-
-// NewRateLimiter creates a new rate limiter
-func NewRateLimiter() *RateLimiter {
-	return &RateLimiter{
-		buckets: make(map[string]*TokenBucket),
+	tb.tokens += 1.0
+	if tb.tokens > tb.capacity {
+		tb.tokens = tb.capacity
 	}
 }
 
-// Allow checks if a tenant's request should be allowed
-func (rl *RateLimiter) Allow(tenantID string, capacity float64, refillRate float64) bool {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+// Reconfigure updates capacity and refill rate in place, clamping the
+// current token count to the new capacity. Lets a Limiter apply a reloaded
+// config to a bucket that's already in use.
+func (tb *TokenBucket) Reconfigure(capacity, refillRate float64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
 
-	bucket, exists := rl.buckets[tenantID]
-	if !exists {
-		bucket = NewTokenBucket(capacity, refillRate)
-		rl.buckets[tenantID] = bucket
+	tb.capacity = capacity
+	tb.refillRate = refillRate
+	if tb.tokens > capacity {
+		tb.tokens = capacity
 	}
-
-	return bucket.Allow()
 }
 
-// GetTokens returns current token count for a tenant (for testing/debugging)
-func (rl *RateLimiter) GetTokens(tenantID string) float64 {
-	rl.mu.RLock()
-	defer rl.mu.RUnlock()
+// Status reports the tokens currently available and when the bucket will
+// next have a full token available, for surfacing as X-RateLimit-Remaining
+// / X-RateLimit-Reset.
+func (tb *TokenBucket) Status(limit RouteLimit) (remaining int, resetAt time.Time) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill()
+	remaining = int(tb.tokens)
 
-	if bucket, exists := rl.buckets[tenantID]; exists {
-		return bucket.Tokens()
+	if tb.tokens >= 1.0 || limit.RefillRate <= 0 {
+		return remaining, time.Now()
 	}
-	return 0
-}
\ No newline at end of file
+	secondsToFull := (1.0 - tb.tokens) / limit.RefillRate
+	return remaining, time.Now().Add(time.Duration(secondsToFull * float64(time.Second)))
+}
+
+// Tokens returns the current number of tokens (for testing/debugging).
+func (tb *TokenBucket) Tokens() float64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.tokens
+}
@@ -0,0 +1,52 @@
+// Package retry implements a shared exponential backoff with jitter
+// strategy used by the notification and message delivery paths so a failing
+// endpoint isn't retried on the very next worker tick.
+package retry
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Policy describes an exponential backoff retry strategy.
+type Policy struct {
+	MaxAttempts  int
+	BaseInterval time.Duration
+	MaxBackoff   time.Duration
+	Jitter       float64 // fractional jitter, e.g. 0.2 for +/-20%
+}
+
+// NextRetryAt computes when the next attempt should run, given the number of
+// attempts made so far: min(BaseInterval * 2^attempts, MaxBackoff) +/- Jitter.
+func (p Policy) NextRetryAt(attempts int, now time.Time) time.Time {
+	backoff := p.BaseInterval
+	for i := 0; i < attempts && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff || backoff <= 0 {
+		backoff = p.MaxBackoff
+	}
+
+	return now.Add(applyJitter(backoff, p.Jitter))
+}
+
+// IsTerminal reports whether a failure at this attempt count should stop
+// retrying and move the entry to the dead letter table.
+func (p Policy) IsTerminal(attempts int) bool {
+	return attempts+1 >= p.MaxAttempts
+}
+
+// applyJitter perturbs d by up to +/-frac of its value.
+func applyJitter(d time.Duration, frac float64) time.Duration {
+	if frac <= 0 {
+		return d
+	}
+
+	delta := float64(d) * frac
+	offset := (rand.Float64()*2 - 1) * delta
+	result := float64(d) + offset
+	if result < 0 {
+		result = 0
+	}
+	return time.Duration(result)
+}
@@ -6,18 +6,21 @@ import (
 	"log/slog"
 	"sort"
 
-	"github.com/Byabasaija/chatapi/internal/models"
 	"github.com/google/uuid"
+	"github.com/hastenr/chatapi/internal/models"
+	"github.com/hastenr/chatapi/internal/pubsub"
 )
 
 // Service handles chatroom operations
 type Service struct {
-	db *sql.DB
+	db  *sql.DB
+	bus *pubsub.Bus
 }
 
-// NewService creates a new chatroom service
-func NewService(db *sql.DB) *Service {
-	return &Service{db: db}
+// NewService creates a new chatroom service. bus may be nil, in which case
+// room events are not published.
+func NewService(db *sql.DB, bus *pubsub.Bus) *Service {
+	return &Service{db: db, bus: bus}
 }
 
 // CreateRoom creates a new chatroom
@@ -44,6 +47,11 @@ func (s *Service) CreateRoom(tenantID string, req *models.CreateRoomRequest) (*m
 	}
 
 	slog.Info("Created room", "tenant_id", tenantID, "room_id", room.RoomID, "type", req.Type)
+
+	if s.bus != nil {
+		s.bus.Publish(tenantID, "room.created", room)
+	}
+
 	return room, nil
 }
 
@@ -243,6 +251,11 @@ func (s *Service) AddMember(tenantID, roomID, userID string) error {
 	}
 
 	slog.Info("Added member to room", "tenant_id", tenantID, "room_id", roomID, "user_id", userID)
+
+	if s.bus != nil {
+		s.bus.Publish(tenantID, "room.member_added", map[string]string{"room_id": roomID, "user_id": userID})
+	}
+
 	return nil
 }
 
@@ -268,6 +281,11 @@ func (s *Service) RemoveMember(tenantID, roomID, userID string) error {
 	}
 
 	slog.Info("Removed member from room", "tenant_id", tenantID, "room_id", roomID, "user_id", userID)
+
+	if s.bus != nil {
+		s.bus.Publish(tenantID, "room.member_removed", map[string]string{"room_id": roomID, "user_id": userID})
+	}
+
 	return nil
 }
 
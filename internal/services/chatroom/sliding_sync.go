@@ -0,0 +1,321 @@
+package chatroom
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hastenr/chatapi/internal/models"
+	"github.com/hastenr/chatapi/internal/sync"
+)
+
+// roomOrdering is the per-room data needed to sort and filter a user's
+// ordered room list for a single sliding sync list.
+type roomOrdering struct {
+	room      models.Room
+	unreadSeq int // last_seq - last_ack for the requesting user
+}
+
+// SlidingSync implements the window-based room listing protocol: for each
+// requested list it computes the ordered set of rooms the user is a member
+// of, slices out the requested ranges, and returns only those rooms plus a
+// minimal op log describing how the visible window changed since the
+// session's previous call.
+func (s *Service) SlidingSync(tenantID, userID, sessionID string, req *sync.Request) (*sync.Response, error) {
+	resp := &sync.Response{
+		Pos:   req.Pos + 1,
+		Lists: make(map[string]sync.ListResponse),
+		Rooms: make(map[string]interface{}),
+	}
+
+	for listName, listReq := range req.Lists {
+		orderings, err := s.orderedRoomsForUser(tenantID, userID, listReq)
+		if err != nil {
+			return nil, fmt.Errorf("failed to order rooms for list %q: %w", listName, err)
+		}
+
+		specHash := hashListSpec(listReq)
+		prevWindows, err := s.loadSyncWindow(tenantID, sessionID, listName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load sync token for list %q: %w", listName, err)
+		}
+
+		windows := make(map[string][]string, len(listReq.Ranges))
+		var ops []Op
+		for _, rng := range listReq.Ranges {
+			ids := windowRoomIDs(orderings, rng)
+			windows[rangeKey(rng)] = ids
+
+			prevIDs, hadPrev := prevWindows[rangeKey(rng)]
+			prevHash, hadHash := prevWindows["__hash__"]
+			if !hadPrev || !hadHash || len(prevHash) == 0 || specHash != prevHash[0] {
+				ops = append(ops, Op{Op: "SYNC", Range: rangePtr(rng), RoomIDs: ids})
+			} else {
+				ops = append(ops, diffWindow(rng, prevIDs, ids)...)
+			}
+
+			for _, r := range orderings {
+				if containsID(ids, r.room.RoomID) {
+					resp.Rooms[r.room.RoomID] = r.room
+				}
+			}
+		}
+		windows["__hash__"] = []string{specHash}
+
+		if err := s.saveSyncWindow(tenantID, sessionID, listName, specHash, windows); err != nil {
+			return nil, fmt.Errorf("failed to persist sync token for list %q: %w", listName, err)
+		}
+
+		resp.Lists[listName] = sync.ListResponse{Count: len(orderings), Ops: toSyncOps(ops)}
+
+		if ext, ok := req.Extensions[listName]; ok && ext.RecentMessages > 0 && len(listReq.Ranges) > 0 {
+			if resp.Extensions == nil {
+				resp.Extensions = make(map[string]interface{})
+			}
+			recent, err := s.recentMessagesForWindow(tenantID, windows[rangeKey(listReq.Ranges[0])], ext.RecentMessages)
+			if err == nil {
+				resp.Extensions["recent_messages"] = recent
+			}
+		}
+	}
+
+	return resp, nil
+}
+
+// Op mirrors sync.Op; kept as a local alias so the diffing helpers below
+// don't need to import the sync package types repeatedly.
+type Op = sync.Op
+
+func toSyncOps(ops []Op) []sync.Op { return ops }
+
+func rangePtr(r sync.Range) *sync.Range { return &r }
+
+func rangeKey(r sync.Range) string { return fmt.Sprintf("%d-%d", r[0], r[1]) }
+
+func containsID(ids []string, id string) bool {
+	for _, existing := range ids {
+		if existing == id {
+			return true
+		}
+	}
+	return false
+}
+
+// orderedRoomsForUser returns the user's rooms in tenantID, sorted according
+// to listReq.Sort and filtered by listReq.RoomTypes if set.
+func (s *Service) orderedRoomsForUser(tenantID, userID string, listReq sync.ListRequest) ([]roomOrdering, error) {
+	query := `
+		SELECT r.room_id, r.tenant_id, r.type, r.unique_key, r.name, r.last_seq, r.last_message_at, r.created_at,
+		       COALESCE(ds.last_ack, 0)
+		FROM rooms r
+		JOIN room_members rm ON rm.tenant_id = r.tenant_id AND rm.chatroom_id = r.room_id
+		LEFT JOIN delivery_state ds ON ds.tenant_id = r.tenant_id AND ds.user_id = rm.user_id AND ds.chatroom_id = r.room_id
+		WHERE r.tenant_id = ? AND rm.user_id = ?
+	`
+
+	rows, err := s.db.Query(query, tenantID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orderings []roomOrdering
+	for rows.Next() {
+		var ro roomOrdering
+		var lastAck int
+		if err := rows.Scan(
+			&ro.room.RoomID, &ro.room.TenantID, &ro.room.Type, &ro.room.UniqueKey,
+			&ro.room.Name, &ro.room.LastSeq, &ro.room.LastMessageAt, &ro.room.CreatedAt,
+			&lastAck,
+		); err != nil {
+			return nil, err
+		}
+		ro.unreadSeq = ro.room.LastSeq - lastAck
+		if roomTypeAllowed(ro.room.Type, listReq.RoomTypes) {
+			orderings = append(orderings, ro)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sortOrderings(orderings, listReq.Sort)
+	return orderings, nil
+}
+
+func roomTypeAllowed(roomType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, t := range allowed {
+		if t == roomType {
+			return true
+		}
+	}
+	return false
+}
+
+func sortOrderings(orderings []roomOrdering, mode string) {
+	switch mode {
+	case "by_unread":
+		sliceSort(orderings, func(a, b roomOrdering) bool { return a.unreadSeq > b.unreadSeq })
+	case "by_name":
+		sliceSort(orderings, func(a, b roomOrdering) bool { return a.room.Name < b.room.Name })
+	default: // "by_recency"
+		sliceSort(orderings, func(a, b roomOrdering) bool {
+			at, bt := a.room.LastMessageAt, b.room.LastMessageAt
+			switch {
+			case at == nil && bt == nil:
+				return a.room.LastSeq > b.room.LastSeq
+			case at == nil:
+				return false
+			case bt == nil:
+				return true
+			default:
+				return at.After(*bt)
+			}
+		})
+	}
+}
+
+// sliceSort is a small insertion sort helper so this file doesn't need to
+// pull in "sort" just for a `less` closure over a struct slice.
+func sliceSort(orderings []roomOrdering, less func(a, b roomOrdering) bool) {
+	for i := 1; i < len(orderings); i++ {
+		for j := i; j > 0 && less(orderings[j], orderings[j-1]); j-- {
+			orderings[j], orderings[j-1] = orderings[j-1], orderings[j]
+		}
+	}
+}
+
+func windowRoomIDs(orderings []roomOrdering, rng sync.Range) []string {
+	start, end := rng[0], rng[1]
+	if start < 0 {
+		start = 0
+	}
+	if end >= len(orderings) {
+		end = len(orderings) - 1
+	}
+	if start > end || start >= len(orderings) {
+		return nil
+	}
+
+	ids := make([]string, 0, end-start+1)
+	for i := start; i <= end; i++ {
+		ids = append(ids, orderings[i].room.RoomID)
+	}
+	return ids
+}
+
+// diffWindow compares the previous and current room IDs at the same window
+// positions and emits the minimal INSERT/DELETE op set.
+func diffWindow(rng sync.Range, prev, curr []string) []Op {
+	var ops []Op
+	maxLen := len(prev)
+	if len(curr) > maxLen {
+		maxLen = len(curr)
+	}
+
+	for i := 0; i < maxLen; i++ {
+		var prevID, currID string
+		if i < len(prev) {
+			prevID = prev[i]
+		}
+		if i < len(curr) {
+			currID = curr[i]
+		}
+		if prevID == currID {
+			continue
+		}
+
+		index := rng[0] + i
+		if currID == "" {
+			ops = append(ops, Op{Op: "DELETE", Index: &index})
+			continue
+		}
+		ops = append(ops, Op{Op: "INSERT", Index: &index, RoomIDs: []string{currID}})
+	}
+
+	return ops
+}
+
+func hashListSpec(req sync.ListRequest) string {
+	b, _ := json.Marshal(req)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadSyncWindow loads the previously persisted window_set for a
+// tenant/session/list, keyed by range (plus a synthetic "__hash__" entry
+// holding the list spec hash it was computed against).
+func (s *Service) loadSyncWindow(tenantID, sessionID, listName string) (map[string][]string, error) {
+	var windowJSON string
+	query := `SELECT window_set FROM sync_tokens WHERE tenant_id = ? AND session_id = ? AND list_name = ?`
+	err := s.db.QueryRow(query, tenantID, sessionID, listName).Scan(&windowJSON)
+	if err == sql.ErrNoRows {
+		return map[string][]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	windows := make(map[string][]string)
+	if err := json.Unmarshal([]byte(windowJSON), &windows); err != nil {
+		return map[string][]string{}, nil
+	}
+	return windows, nil
+}
+
+func (s *Service) saveSyncWindow(tenantID, sessionID, listName, specHash string, windows map[string][]string) error {
+	windowJSON, err := json.Marshal(windows)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO sync_tokens (tenant_id, session_id, list_name, pos, list_spec_hash, window_set, updated_at)
+		VALUES (?, ?, ?, 1, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (tenant_id, session_id, list_name) DO UPDATE SET
+			pos = pos + 1,
+			list_spec_hash = excluded.list_spec_hash,
+			window_set = excluded.window_set,
+			updated_at = CURRENT_TIMESTAMP
+	`
+	_, err = s.db.Exec(query, tenantID, sessionID, listName, specHash, string(windowJSON))
+	return err
+}
+
+// recentMessagesForWindow hydrates the trailing N messages for each room
+// currently in view, so callers that opt in via extensions avoid a
+// per-room follow-up request.
+func (s *Service) recentMessagesForWindow(tenantID string, roomIDs []string, limit int) (map[string][]models.Message, error) {
+	result := make(map[string][]models.Message, len(roomIDs))
+	for _, roomID := range roomIDs {
+		query := `
+			SELECT message_id, tenant_id, chatroom_id, sender_id, seq, content, meta, created_at
+			FROM messages
+			WHERE tenant_id = ? AND chatroom_id = ?
+			ORDER BY seq DESC
+			LIMIT ?
+		`
+		rows, err := s.db.Query(query, tenantID, roomID, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		var msgs []models.Message
+		for rows.Next() {
+			var m models.Message
+			if err := rows.Scan(&m.MessageID, &m.TenantID, &m.ChatroomID, &m.SenderID, &m.Seq, &m.Content, &m.Meta, &m.CreatedAt); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			msgs = append(msgs, m)
+		}
+		rows.Close()
+		result[roomID] = msgs
+	}
+	return result, nil
+}
@@ -2,19 +2,37 @@ package delivery
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"time"
 
-	"github.com/yourusername/chatapi/internal/models"
-	"github.com/yourusername/chatapi/internal/services/realtime"
+	"github.com/hastenr/chatapi/internal/models"
+	"github.com/hastenr/chatapi/internal/retry"
+	"github.com/hastenr/chatapi/internal/services/message"
+	"github.com/hastenr/chatapi/internal/services/notification"
+	"github.com/hastenr/chatapi/internal/services/realtime"
+	"github.com/hastenr/chatapi/internal/services/tenant"
 )
 
+// defaultRetryPolicy is used until SetRetryPolicy is called with values from
+// config.Config.
+var defaultRetryPolicy = retry.Policy{
+	MaxAttempts:  5,
+	BaseInterval: 30 * time.Second,
+	MaxBackoff:   1 * time.Hour,
+	Jitter:       0.2,
+}
+
 // Service handles message and notification delivery with retries
 type Service struct {
-	db         *sql.DB
+	db          *sql.DB
 	realtimeSvc *realtime.Service
+	notifSvc    *notification.Service
+	messageSvc  *message.Service
+	tenantSvc   *tenant.Service
 	maxAttempts int
+	retryPolicy retry.Policy
 }
 
 // NewService creates a new delivery service
@@ -22,25 +40,77 @@ func NewService(db *sql.DB, realtimeSvc *realtime.Service) *Service {
 	return &Service{
 		db:          db,
 		realtimeSvc: realtimeSvc,
-		maxAttempts: 5,
+		maxAttempts: defaultRetryPolicy.MaxAttempts,
+		retryPolicy: defaultRetryPolicy,
 	}
 }
 
+// SetRetryPolicy overrides the exponential backoff policy used for
+// undelivered messages
+func (s *Service) SetRetryPolicy(p retry.Policy) {
+	s.retryPolicy = p
+	s.maxAttempts = p.MaxAttempts
+}
+
+// SetNotificationService wires in the notification service so
+// ProcessNotifications and CleanupOldEntries can pump/truncate topic logs.
+// Must be called before either runs; ProcessNotifications is a no-op until
+// it is.
+func (s *Service) SetNotificationService(n *notification.Service) {
+	s.notifSvc = n
+}
+
+// SetMessageService wires in the message service so CleanupOldEntries can
+// also truncate delivered message logs. CleanupOldEntries skips that step
+// until it is.
+func (s *Service) SetMessageService(m *message.Service) {
+	s.messageSvc = m
+}
+
+// SetTenantService wires in the tenant service so message retries respect
+// each tenant's configured TenantConfig.RetryLimit instead of the shared
+// retryPolicy.MaxAttempts. Retries fall back to the shared policy until this
+// is called, or for a tenant whose config can't be loaded.
+func (s *Service) SetTenantService(t *tenant.Service) {
+	s.tenantSvc = t
+}
+
+// retryPolicyFor returns s.retryPolicy with MaxAttempts overridden by
+// tenantID's configured RetryLimit, so a noisier tenant can be tuned to give
+// up sooner (or retry harder) without changing the shared backoff curve.
+func (s *Service) retryPolicyFor(tenantID string) retry.Policy {
+	policy := s.retryPolicy
+	if s.tenantSvc == nil {
+		return policy
+	}
+
+	cfg, err := s.tenantSvc.GetTenantConfig(tenantID)
+	if err != nil || cfg.RetryLimit <= 0 {
+		return policy
+	}
+
+	policy.MaxAttempts = cfg.RetryLimit
+	return policy
+}
+
 // ProcessUndeliveredMessages processes messages that haven't been delivered yet
 func (s *Service) ProcessUndeliveredMessages(tenantID string, limit int) error {
 	if limit <= 0 || limit > 100 {
 		limit = 50
 	}
 
+	retryLimit := s.retryPolicyFor(tenantID).MaxAttempts
+
 	query := `
 		SELECT id, tenant_id, user_id, chatroom_id, message_id, seq, attempts
 		FROM undelivered_messages
 		WHERE tenant_id = ? AND attempts < ?
+			AND (next_retry_at IS NULL OR next_retry_at <= CURRENT_TIMESTAMP)
 		ORDER BY created_at ASC
 		LIMIT ?
 	`
 
-	rows, err := s.db.Query(query, tenantID, s.maxAttempts, limit)
+	rows, err := s.db.Query(query, tenantID, retryLimit, limit)
 	if err != nil {
 		return fmt.Errorf("failed to get undelivered messages: %w", err)
 	}
@@ -86,13 +156,13 @@ func (s *Service) attemptMessageDelivery(msg *models.UndeliveredMessage) error {
 
 		// Send via WebSocket
 		messagePayload := map[string]interface{}{
-			"type":        "message",
-			"room_id":     msg.ChatroomID,
-			"seq":         msg.Seq,
-			"message_id":  msg.MessageID,
-			"sender_id":   fullMsg.SenderID,
-			"content":     fullMsg.Content,
-			"created_at":  fullMsg.CreatedAt.Format(time.RFC3339),
+			"type":       "message",
+			"room_id":    msg.ChatroomID,
+			"seq":        msg.Seq,
+			"message_id": msg.MessageID,
+			"sender_id":  fullMsg.SenderID,
+			"content":    fullMsg.Content,
+			"created_at": fullMsg.CreatedAt.Format(time.RFC3339),
 		}
 
 		if fullMsg.Meta != "" {
@@ -106,48 +176,35 @@ func (s *Service) attemptMessageDelivery(msg *models.UndeliveredMessage) error {
 	}
 
 	// User is offline, increment attempts
-	return s.incrementMessageAttempts(msg.ID)
+	return s.incrementMessageAttempts(msg, "user offline")
 }
 
-// ProcessNotifications processes pending notifications
+// ProcessNotifications pumps every tenantID subscriber that is online
+// forward from its committed topiclog cursor to the topic's tail, rather
+// than polling the notifications table: each subscriber's cursor (topic,
+// subscriber) is its own resumable position in that topic's WAL, so a
+// subscriber that's offline simply falls behind and catches up from its
+// cursor on its next WebSocket subscribe/replay instead of losing anything.
+// Webhook-endpoint subscribers are pumped separately by webhook.Service.
 func (s *Service) ProcessNotifications(tenantID string, limit int) error {
+	if s.notifSvc == nil {
+		return nil
+	}
 	if limit <= 0 || limit > 100 {
 		limit = 50
 	}
 
-	query := `
-		SELECT notification_id, tenant_id, topic, payload, attempts
-		FROM notifications
-		WHERE tenant_id = ? AND status IN ('pending', 'processing') AND attempts < ?
-		ORDER BY created_at ASC
-		LIMIT ?
-	`
-
-	rows, err := s.db.Query(query, tenantID, s.maxAttempts, limit)
+	subs, err := s.notifSvc.GetInAppSubscriptions(tenantID)
 	if err != nil {
-		return fmt.Errorf("failed to get pending notifications: %w", err)
+		return fmt.Errorf("failed to load in-app subscriptions: %w", err)
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var notif models.Notification
-		err := rows.Scan(
-			&notif.NotificationID,
-			&notif.TenantID,
-			&notif.Topic,
-			&notif.Payload,
-			&notif.Attempts,
-		)
-		if err != nil {
-			slog.Error("Failed to scan notification", "error", err)
-			continue
-		}
 
-		if err := s.attemptNotificationDelivery(&notif); err != nil {
-			slog.Warn("Failed to deliver notification",
-				"notification_id", notif.NotificationID,
-				"topic", notif.Topic,
-				"attempts", notif.Attempts,
+	for _, sub := range subs {
+		if err := s.pumpSubscriber(tenantID, sub, limit); err != nil {
+			slog.Warn("Failed to pump topic subscriber",
+				"tenant_id", tenantID,
+				"topic", sub.Topic,
+				"subscriber_id", sub.SubscriberID,
 				"error", err)
 		}
 	}
@@ -155,31 +212,43 @@ func (s *Service) ProcessNotifications(tenantID string, limit int) error {
 	return nil
 }
 
-// attemptNotificationDelivery tries to deliver a notification
-func (s *Service) attemptNotificationDelivery(notif *models.Notification) error {
-	// For now, broadcast to all online users in the tenant
-	// In a more sophisticated implementation, you'd look up subscribers
-	// and send to specific users or endpoints
-
-	notificationPayload := map[string]interface{}{
-		"type":            "notification",
-		"notification_id": notif.NotificationID,
-		"topic":           notif.Topic,
-		"payload":         notif.Payload,
-		"timestamp":       time.Now().Unix(),
+// pumpSubscriber replays sub's topic from its committed cursor to the tail
+// over its WebSocket connection, then advances the cursor past whatever it
+// just sent. It is a no-op for a subscriber that isn't currently online.
+func (s *Service) pumpSubscriber(tenantID string, sub *models.NotificationSubscription, limit int) error {
+	if !s.realtimeSvc.IsUserOnline(tenantID, sub.SubscriberID) {
+		return nil
 	}
 
-	// Get online users and send to them
-	onlineUsers := s.realtimeSvc.GetOnlineUsers(notif.TenantID)
-	for _, userID := range onlineUsers {
-		s.realtimeSvc.SendToUser(notif.TenantID, userID, notificationPayload)
+	cursor, err := s.notifSvc.GetCursor(tenantID, sub.Topic, sub.SubscriberID)
+	if err != nil {
+		return fmt.Errorf("failed to load cursor: %w", err)
+	}
+
+	messages, err := s.notifSvc.ReadTopic(tenantID, sub.Topic, cursor, limit)
+	if err != nil {
+		return fmt.Errorf("failed to read topic log: %w", err)
+	}
+	if len(messages) == 0 {
+		return nil
 	}
 
-	// Mark as delivered (simplified - in reality, you'd track per-user delivery)
-	return s.markNotificationDelivered(notif.NotificationID)
+	for _, msg := range messages {
+		s.realtimeSvc.SendToUser(tenantID, sub.SubscriberID, map[string]interface{}{
+			"type":  "topic.message",
+			"topic": msg.Topic,
+			"seq":   msg.Seq,
+			"data":  msg.Payload,
+		})
+		cursor = msg.Seq
+	}
+
+	return s.notifSvc.CommitCursor(tenantID, sub.Topic, sub.SubscriberID, cursor)
 }
 
-// CleanupOldEntries removes old delivered entries to prevent unbounded growth
+// CleanupOldEntries removes old delivered entries to prevent unbounded
+// growth, and truncates every subscribed topic's topiclog WAL up to the
+// minimum committed cursor across its live subscribers.
 func (s *Service) CleanupOldEntries(tenantID string, maxAge time.Duration) error {
 	cutoffTime := time.Now().Add(-maxAge)
 
@@ -208,6 +277,24 @@ func (s *Service) CleanupOldEntries(tenantID string, maxAge time.Duration) error
 		return fmt.Errorf("failed to cleanup old notifications: %w", err)
 	}
 
+	if s.notifSvc != nil {
+		topics, err := s.notifSvc.ListSubscribedTopics(tenantID)
+		if err != nil {
+			return fmt.Errorf("failed to list subscribed topics: %w", err)
+		}
+		for _, topic := range topics {
+			if err := s.notifSvc.TruncateTopic(tenantID, topic); err != nil {
+				slog.Warn("Failed to truncate topic log", "tenant_id", tenantID, "topic", topic, "error", err)
+			}
+		}
+	}
+
+	if s.messageSvc != nil {
+		if err := s.messageSvc.TruncateDeliveredLogs(tenantID); err != nil {
+			slog.Warn("Failed to truncate message logs", "tenant_id", tenantID, "error", err)
+		}
+	}
+
 	slog.Info("Cleaned up old delivery entries",
 		"tenant_id", tenantID,
 		"max_age", maxAge)
@@ -249,22 +336,113 @@ func (s *Service) markMessageDelivered(id int) error {
 	return err
 }
 
-func (s *Service) incrementMessageAttempts(id int) error {
+// deadMessagePayload is what moveMessageToDeadLetter stores as dead_letter's
+// payload for kind "message" - enough to rebuild the undelivered_messages
+// row on RequeueDeadLetter, since the original row is gone by then.
+type deadMessagePayload struct {
+	UserID     string `json:"user_id"`
+	ChatroomID string `json:"chatroom_id"`
+	MessageID  string `json:"message_id"`
+	Seq        int    `json:"seq"`
+}
+
+// incrementMessageAttempts records a failed delivery attempt, scheduling the
+// next retry with backoff + jitter, or moving the message to the dead letter
+// table once it exhausts msg.TenantID's configured retry limit.
+func (s *Service) incrementMessageAttempts(msg *models.UndeliveredMessage, lastErr string) error {
+	policy := s.retryPolicyFor(msg.TenantID)
+
+	if policy.IsTerminal(msg.Attempts) {
+		return s.moveMessageToDeadLetter(msg, lastErr)
+	}
+
+	nextRetryAt := policy.NextRetryAt(msg.Attempts, time.Now())
 	query := `
 		UPDATE undelivered_messages
-		SET attempts = attempts + 1, last_attempt_at = CURRENT_TIMESTAMP
+		SET attempts = attempts + 1, last_attempt_at = CURRENT_TIMESTAMP, next_retry_at = ?, last_error = ?
 		WHERE id = ?
 	`
-	_, err := s.db.Exec(query, id)
+	_, err := s.db.Exec(query, nextRetryAt, lastErr, msg.ID)
 	return err
 }
 
-func (s *Service) markNotificationDelivered(notificationID string) error {
+// moveMessageToDeadLetter records an undelivered message that exhausted its
+// retries so operators can inspect and requeue it, then removes it from the
+// active queue.
+func (s *Service) moveMessageToDeadLetter(msg *models.UndeliveredMessage, lastErr string) error {
+	payload, err := json.Marshal(deadMessagePayload{
+		UserID:     msg.UserID,
+		ChatroomID: msg.ChatroomID,
+		MessageID:  msg.MessageID,
+		Seq:        msg.Seq,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode dead-letter payload: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO dead_letter (tenant_id, kind, ref_id, payload, last_error, attempts)
+		VALUES (?, 'message', ?, ?, ?, ?)
+	`, msg.TenantID, msg.MessageID, string(payload), lastErr, msg.Attempts+1)
+	if err != nil {
+		return fmt.Errorf("failed to insert dead letter entry: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM undelivered_messages WHERE id = ?`, msg.ID); err != nil {
+		return fmt.Errorf("failed to remove dead undelivered message: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// GetDeadLetters retrieves entries that exhausted their delivery retries
+// (messages, notifications, and webhook deliveries alike) for operator
+// inspection
+func (s *Service) GetDeadLetters(tenantID string, limit int) ([]*models.DeadLetterEntry, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
 	query := `
-		UPDATE notifications
-		SET status = 'delivered', last_attempt_at = CURRENT_TIMESTAMP
-		WHERE notification_id = ?
+		SELECT id, tenant_id, kind, ref_id, payload, last_error, attempts, created_at
+		FROM dead_letter
+		WHERE tenant_id = ?
+		ORDER BY created_at DESC
+		LIMIT ?
 	`
-	_, err := s.db.Exec(query, notificationID)
-	return err
-}
\ No newline at end of file
+
+	rows, err := s.db.Query(query, tenantID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []*models.DeadLetterEntry
+	for rows.Next() {
+		var e models.DeadLetterEntry
+		var lastError sql.NullString
+		err := rows.Scan(
+			&e.ID,
+			&e.TenantID,
+			&e.Kind,
+			&e.RefID,
+			&e.Payload,
+			&lastError,
+			&e.Attempts,
+			&e.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan dead letter: %w", err)
+		}
+		e.LastError = lastError.String
+		entries = append(entries, &e)
+	}
+
+	return entries, nil
+}
@@ -1,92 +1,183 @@
 package message
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/Byabasaija/chatapi/internal/models"
 	"github.com/google/uuid"
+	"github.com/hastenr/chatapi/internal/models"
+	"github.com/hastenr/chatapi/internal/netutil"
+	mwal "github.com/hastenr/chatapi/internal/services/message/wal"
 )
 
-// Service handles message operations
+// tailReadWindow bounds how far behind last_seq afterSeq can be for
+// GetMessages to serve a tail read straight out of the WAL; anything further
+// behind falls back to SQL, since the WAL only holds what hasn't been
+// truncated past the slowest acker (see Service.TruncateDeliveredLogs).
+const tailReadWindow = 500
+
+// Waker is notified whenever new work is inserted so a long-polling worker
+// can wake up immediately instead of waiting for its next tick.
+type Waker interface {
+	WakeUp(tenantID string)
+}
+
+// roomCounter is the in-memory sequence allocator for a single room,
+// guarded by its own mutex so SendMessage for one room never blocks on
+// another's.
+type roomCounter struct {
+	mu  sync.Mutex
+	seq uint64
+}
+
+// Service handles message operations. Writes go first to wal - an
+// append-only per-room log - which hands out the seq and makes the write
+// durable without a SQL transaction, then are mirrored into SQLite
+// asynchronously so GetMessages can keep serving deep history and
+// cross-room queries from SQL. See internal/services/message/wal's doc
+// comment for why this mirrors topiclog's design.
 type Service struct {
-	db *sql.DB
+	db    *sql.DB
+	waker Waker
+	wal   *mwal.Log
+
+	countersMu sync.Mutex
+	counters   map[string]*roomCounter
 }
 
-// NewService creates a new message service
-func NewService(db *sql.DB) *Service {
-	return &Service{db: db}
+// NewService creates a new message service backed by walLog.
+func NewService(db *sql.DB, walLog *mwal.Log) *Service {
+	return &Service{db: db, wal: walLog, counters: make(map[string]*roomCounter)}
 }
 
-// SendMessage stores a message transactionally with sequencing
-func (s *Service) SendMessage(tenantID, roomID, senderID string, req *models.CreateMessageRequest) (*models.Message, error) {
-	// Start transaction
-	tx, err := s.db.Begin()
+// SetWaker registers a Waker to be notified after messages are inserted
+func (s *Service) SetWaker(w Waker) {
+	s.waker = w
+}
+
+// RecoverSequences reconstructs rooms.last_seq from the max sequence found
+// in each room's on-disk WAL, and seeds this Service's in-memory counters
+// from it. Call this once at startup, before any SendMessage: it protects
+// against a process that crashed after a WAL append but before its SQLite
+// mirror committed, which would otherwise let SendMessage reuse a sequence
+// that's already on disk.
+func (s *Service) RecoverSequences() error {
+	recovered, err := s.wal.Recover()
 	if err != nil {
-		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+		return fmt.Errorf("failed to recover message logs: %w", err)
 	}
-	defer tx.Rollback()
 
-	// Increment room sequence
-	updateSeqQuery := `
-		UPDATE rooms
-		SET last_seq = last_seq + 1
-		WHERE tenant_id = ? AND room_id = ?
-	`
+	for _, r := range recovered {
+		if r.LastSeq == 0 {
+			continue
+		}
 
-	result, err := tx.Exec(updateSeqQuery, tenantID, roomID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to update room sequence: %w", err)
+		_, err := s.db.Exec(`
+			UPDATE rooms SET last_seq = ? WHERE tenant_id = ? AND room_id = ? AND last_seq < ?
+		`, r.LastSeq, r.TenantID, r.RoomID, r.LastSeq)
+		if err != nil {
+			return fmt.Errorf("failed to reconcile last_seq for room %s: %w", r.RoomID, err)
+		}
+
+		rc, err := s.counterFor(r.TenantID, r.RoomID)
+		if err != nil {
+			return err
+		}
+		rc.mu.Lock()
+		if r.LastSeq > rc.seq {
+			rc.seq = r.LastSeq
+		}
+		rc.mu.Unlock()
+
+		slog.Info("Recovered message log sequence", "tenant_id", r.TenantID, "room_id", r.RoomID, "seq", r.LastSeq)
+	}
+
+	return nil
+}
+
+// counterFor returns the in-memory sequence counter for (tenantID, roomID),
+// seeding it from rooms.last_seq and the WAL's own tail (the higher of the
+// two) on first access.
+func (s *Service) counterFor(tenantID, roomID string) (*roomCounter, error) {
+	key := tenantID + "|" + roomID
+
+	s.countersMu.Lock()
+	defer s.countersMu.Unlock()
+
+	if rc, ok := s.counters[key]; ok {
+		return rc, nil
+	}
+
+	var dbSeq uint64
+	err := s.db.QueryRow(`SELECT last_seq FROM rooms WHERE tenant_id = ? AND room_id = ?`, tenantID, roomID).Scan(&dbSeq)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to load room sequence: %w", err)
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	walSeq, err := s.wal.LastSeq(tenantID, roomID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get rows affected: %w", err)
+		return nil, fmt.Errorf("failed to load message log tail: %w", err)
 	}
 
-	if rowsAffected == 0 {
-		return nil, fmt.Errorf("room not found")
+	seq := dbSeq
+	if walSeq > seq {
+		seq = walSeq
 	}
 
-	// Get the new sequence number
-	var seq int
-	getSeqQuery := `
-		SELECT last_seq
-		FROM rooms
-		WHERE tenant_id = ? AND room_id = ?
-	`
+	rc := &roomCounter{seq: seq}
+	s.counters[key] = rc
+	return rc, nil
+}
 
-	err = tx.QueryRow(getSeqQuery, tenantID, roomID).Scan(&seq)
+// SendMessage allocates the room's next sequence from its in-memory
+// counter, appends the message to the room's WAL, and returns immediately;
+// the SQLite mirror that makes the message visible to GetMessages' SQL
+// fallback, GetMessage, and sliding sync happens in the background (see
+// mirrorToSQL), since the WAL write is already the durable, ordered record.
+// ctx is only consulted for its netutil.ClientIPFromContext value, included
+// in the "Message sent" audit log when present.
+func (s *Service) SendMessage(ctx context.Context, tenantID, roomID, senderID string, req *models.CreateMessageRequest) (*models.Message, error) {
+	rc, err := s.counterFor(tenantID, roomID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get sequence number: %w", err)
+		return nil, err
 	}
 
-	// Generate message ID (in production, use UUID)
-	messageID := generateMessageID()
-
-	// Prepare metadata JSON
 	var metaJSON string
 	if req.Meta != "" {
 		metaJSON = req.Meta
 	}
 
-	// Insert message
+	messageID := generateMessageID()
 	now := time.Now()
-	insertQuery := `
-		INSERT INTO messages (message_id, tenant_id, chatroom_id, sender_id, seq, content, meta, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`
-
-	_, err = tx.Exec(insertQuery, messageID, tenantID, roomID, senderID, seq, req.Content, metaJSON, now)
-	if err != nil {
-		return nil, fmt.Errorf("failed to insert message: %w", err)
+	eventID := computeEventID(tenantID, roomID, senderID, req.Content, metaJSON, now)
+
+	rc.mu.Lock()
+	seq := rc.seq + 1
+	err = s.wal.Append(tenantID, roomID, mwal.Entry{
+		Seq:       seq,
+		MessageID: messageID,
+		SenderID:  senderID,
+		Content:   req.Content,
+		Meta:      metaJSON,
+		CreatedAt: now,
+		EventID:   eventID,
+	})
+	if err == nil {
+		rc.seq = seq
 	}
+	rc.mu.Unlock()
 
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to append to message log: %w", err)
 	}
 
 	message := &models.Message{
@@ -94,28 +185,79 @@ func (s *Service) SendMessage(tenantID, roomID, senderID string, req *models.Cre
 		TenantID:   tenantID,
 		ChatroomID: roomID,
 		SenderID:   senderID,
-		Seq:        seq,
+		Seq:        int(seq),
 		Content:    req.Content,
 		Meta:       metaJSON,
 		CreatedAt:  now,
+		EventID:    eventID,
 	}
 
-	slog.Info("Message sent",
+	go s.mirrorToSQL(message)
+
+	logArgs := []any{
 		"tenant_id", tenantID,
 		"room_id", roomID,
 		"message_id", messageID,
 		"sender_id", senderID,
-		"seq", seq)
+		"seq", seq,
+	}
+	if clientIP, ok := netutil.ClientIPFromContext(ctx); ok {
+		logArgs = append(logArgs, "client_ip", clientIP.String())
+	}
+	slog.Info("Message sent", logArgs...)
 
 	return message, nil
 }
 
-// GetMessages retrieves messages for a room with pagination
+// mirrorToSQL persists a message already durable in the WAL into SQLite, so
+// the rest of the system (SQL-backed history, sliding sync, dead letter
+// lookups) keeps working unchanged. It runs off the SendMessage hot path;
+// a failure here is logged, not returned, since the message is already
+// durably ordered in the WAL and will still be served from there until the
+// next successful mirror catches SQLite back up.
+func (s *Service) mirrorToSQL(msg *models.Message) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		slog.Error("Failed to begin message mirror transaction", "error", err, "message_id", msg.MessageID)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE rooms SET last_seq = ?, last_message_at = ? WHERE tenant_id = ? AND room_id = ? AND last_seq < ?
+	`, msg.Seq, msg.CreatedAt, msg.TenantID, msg.ChatroomID, msg.Seq)
+	if err != nil {
+		slog.Error("Failed to mirror room sequence", "error", err, "message_id", msg.MessageID)
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT OR IGNORE INTO messages (message_id, tenant_id, chatroom_id, sender_id, seq, content, meta, created_at, event_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, msg.MessageID, msg.TenantID, msg.ChatroomID, msg.SenderID, msg.Seq, msg.Content, msg.Meta, msg.CreatedAt, nullableString(msg.EventID))
+	if err != nil {
+		slog.Error("Failed to mirror message", "error", err, "message_id", msg.MessageID)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.Error("Failed to commit message mirror", "error", err, "message_id", msg.MessageID)
+	}
+}
+
+// GetMessages retrieves messages for a room with pagination. When afterSeq
+// is within tailReadWindow of the room's last sequence, it is served
+// straight from the WAL (no SQL round trip); otherwise it falls back to the
+// SQLite mirror, which holds full history the WAL may have truncated past.
 func (s *Service) GetMessages(tenantID, roomID string, afterSeq, limit int) ([]*models.Message, error) {
 	if limit <= 0 || limit > 100 {
 		limit = 50 // default limit
 	}
 
+	if lastSeq, err := s.wal.LastSeq(tenantID, roomID); err == nil && lastSeq > 0 && lastSeq-uint64(max(afterSeq, 0)) <= tailReadWindow {
+		return s.getMessagesFromWAL(tenantID, roomID, afterSeq, limit)
+	}
+
 	query := `
 		SELECT message_id, tenant_id, chatroom_id, sender_id, seq, content, meta, created_at
 		FROM messages
@@ -160,11 +302,38 @@ func (s *Service) GetMessages(tenantID, roomID string, afterSeq, limit int) ([]*
 	return messages, nil
 }
 
+// getMessagesFromWAL serves a GetMessages tail read directly out of the
+// room's WAL, converting log entries to models.Message without touching
+// SQLite.
+func (s *Service) getMessagesFromWAL(tenantID, roomID string, afterSeq, limit int) ([]*models.Message, error) {
+	entries, err := s.wal.Read(tenantID, roomID, uint64(max(afterSeq, 0)), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message log: %w", err)
+	}
+
+	messages := make([]*models.Message, len(entries))
+	for i, e := range entries {
+		messages[i] = &models.Message{
+			MessageID:  e.MessageID,
+			TenantID:   tenantID,
+			ChatroomID: roomID,
+			SenderID:   e.SenderID,
+			Seq:        int(e.Seq),
+			Content:    e.Content,
+			Meta:       e.Meta,
+			CreatedAt:  e.CreatedAt,
+			EventID:    e.EventID,
+		}
+	}
+	return messages, nil
+}
+
 // GetMessage retrieves a single message by ID
 func (s *Service) GetMessage(tenantID, messageID string) (*models.Message, error) {
 	var msg models.Message
+	var eventID sql.NullString
 	query := `
-		SELECT message_id, tenant_id, chatroom_id, sender_id, seq, content, meta, created_at
+		SELECT message_id, tenant_id, chatroom_id, sender_id, seq, content, meta, created_at, event_id
 		FROM messages
 		WHERE tenant_id = ? AND message_id = ?
 	`
@@ -178,6 +347,7 @@ func (s *Service) GetMessage(tenantID, messageID string) (*models.Message, error
 		&msg.Content,
 		&msg.Meta,
 		&msg.CreatedAt,
+		&eventID,
 	)
 
 	if err == sql.ErrNoRows {
@@ -186,6 +356,7 @@ func (s *Service) GetMessage(tenantID, messageID string) (*models.Message, error
 	if err != nil {
 		return nil, fmt.Errorf("failed to get message: %w", err)
 	}
+	msg.EventID = eventID.String
 
 	return &msg, nil
 }
@@ -237,6 +408,193 @@ func (s *Service) UpdateLastAck(tenantID, userID, roomID string, seq int) error
 	return nil
 }
 
+// TruncateDeliveredLogs truncates every tenant room's WAL up to the minimum
+// last_ack across its members, so space is reclaimed once everyone has
+// acked past a point. A room with no members, or a member that has never
+// acked, has no safe floor and is left untouched.
+func (s *Service) TruncateDeliveredLogs(tenantID string) error {
+	rows, err := s.db.Query(`SELECT room_id FROM rooms WHERE tenant_id = ?`, tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to list rooms: %w", err)
+	}
+	defer rows.Close()
+
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err := rows.Scan(&roomID); err != nil {
+			return fmt.Errorf("failed to scan room: %w", err)
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, roomID := range roomIDs {
+		minAck, ok, err := s.minLastAck(tenantID, roomID)
+		if err != nil {
+			slog.Warn("Failed to compute minimum last ack", "tenant_id", tenantID, "room_id", roomID, "error", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if err := s.wal.Truncate(tenantID, roomID, uint64(minAck)); err != nil {
+			slog.Warn("Failed to truncate message log", "tenant_id", tenantID, "room_id", roomID, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// minLastAck returns the lowest last_ack across roomID's members (0 for a
+// member that has never acked), and false if the room has no members, in
+// which case there is no safe truncation floor.
+func (s *Service) minLastAck(tenantID, roomID string) (int, bool, error) {
+	var minAck sql.NullInt64
+	err := s.db.QueryRow(`
+		SELECT MIN(COALESCE(ds.last_ack, 0))
+		FROM room_members rm
+		LEFT JOIN delivery_state ds
+			ON ds.tenant_id = rm.tenant_id AND ds.user_id = rm.user_id AND ds.chatroom_id = rm.chatroom_id
+		WHERE rm.tenant_id = ? AND rm.chatroom_id = ?
+	`, tenantID, roomID).Scan(&minAck)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to compute minimum last ack: %w", err)
+	}
+	if !minAck.Valid {
+		return 0, false, nil
+	}
+	return int(minAck.Int64), true, nil
+}
+
+// GetUserRoomCursors returns userID's last_ack for every room it is a
+// member of (0 for a room it has never acked), for a reconnect sync that
+// didn't supply its own cursors.
+func (s *Service) GetUserRoomCursors(tenantID, userID string) (map[string]int, error) {
+	rows, err := s.db.Query(`
+		SELECT rm.chatroom_id, COALESCE(ds.last_ack, 0)
+		FROM room_members rm
+		LEFT JOIN delivery_state ds
+			ON ds.tenant_id = rm.tenant_id AND ds.user_id = rm.user_id AND ds.chatroom_id = rm.chatroom_id
+		WHERE rm.tenant_id = ? AND rm.user_id = ?
+	`, tenantID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room cursors: %w", err)
+	}
+	defer rows.Close()
+
+	cursors := make(map[string]int)
+	for rows.Next() {
+		var roomID string
+		var lastAck int
+		if err := rows.Scan(&roomID, &lastAck); err != nil {
+			return nil, fmt.Errorf("failed to scan room cursor: %w", err)
+		}
+		cursors[roomID] = lastAck
+	}
+	return cursors, rows.Err()
+}
+
+// GetLastSeq returns roomID's current sequence number, preferring the WAL's
+// tail (the most up to date, even if its SQLite mirror hasn't caught up
+// yet) and falling back to rooms.last_seq for a room with no WAL activity.
+func (s *Service) GetLastSeq(tenantID, roomID string) (int, error) {
+	walSeq, err := s.wal.LastSeq(tenantID, roomID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read message log tail: %w", err)
+	}
+	if walSeq > 0 {
+		return int(walSeq), nil
+	}
+
+	var lastSeq int
+	err = s.db.QueryRow(`SELECT last_seq FROM rooms WHERE tenant_id = ? AND room_id = ?`, tenantID, roomID).Scan(&lastSeq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last seq: %w", err)
+	}
+	return lastSeq, nil
+}
+
+// GetMessagesBatch fetches up to limit messages with seq > cursors[roomID]
+// for every room in cursors, in a single UNION ALL query instead of one
+// round trip per room. The returned more map marks rooms whose result was
+// truncated to limit, i.e. where the caller should schedule a follow-up
+// batch to keep draining that room.
+func (s *Service) GetMessagesBatch(tenantID string, cursors map[string]int, limit int) (map[string][]*models.Message, map[string]bool, error) {
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	if len(cursors) == 0 {
+		return map[string][]*models.Message{}, map[string]bool{}, nil
+	}
+
+	roomIDs := make([]string, 0, len(cursors))
+	for roomID := range cursors {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Strings(roomIDs)
+
+	// Fetch one extra row per room so a full page tells us the room was
+	// truncated, without a second COUNT query.
+	fetch := limit + 1
+
+	parts := make([]string, 0, len(roomIDs))
+	args := make([]interface{}, 0, len(roomIDs)*4)
+	for _, roomID := range roomIDs {
+		// SQLite allows ORDER BY/LIMIT per room only inside a subquery, not
+		// on a bare UNION ALL member.
+		parts = append(parts, `SELECT * FROM (SELECT message_id, tenant_id, chatroom_id, sender_id, seq, content, meta, created_at
+			FROM messages WHERE tenant_id = ? AND chatroom_id = ? AND seq > ? ORDER BY seq ASC LIMIT ?)`)
+		args = append(args, tenantID, roomID, cursors[roomID], fetch)
+	}
+	query := strings.Join(parts, " UNION ALL ")
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get message batch: %w", err)
+	}
+	defer rows.Close()
+
+	byRoom := make(map[string][]*models.Message, len(roomIDs))
+	for rows.Next() {
+		var msg models.Message
+		err := rows.Scan(
+			&msg.MessageID,
+			&msg.TenantID,
+			&msg.ChatroomID,
+			&msg.SenderID,
+			&msg.Seq,
+			&msg.Content,
+			&msg.Meta,
+			&msg.CreatedAt,
+		)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		byRoom[msg.ChatroomID] = append(byRoom[msg.ChatroomID], &msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	more := make(map[string]bool, len(roomIDs))
+	for roomID, msgs := range byRoom {
+		sort.Slice(msgs, func(i, j int) bool { return msgs[i].Seq < msgs[j].Seq })
+		if len(msgs) > limit {
+			more[roomID] = true
+			msgs = msgs[:limit]
+		}
+		byRoom[roomID] = msgs
+	}
+
+	return byRoom, more, nil
+}
+
 // QueueUndeliveredMessage queues a message for delivery to offline users
 func (s *Service) QueueUndeliveredMessage(tenantID, userID, roomID, messageID string, seq int) error {
 	query := `
@@ -249,6 +607,10 @@ func (s *Service) QueueUndeliveredMessage(tenantID, userID, roomID, messageID st
 		return fmt.Errorf("failed to queue undelivered message: %w", err)
 	}
 
+	if s.waker != nil {
+		s.waker.WakeUp(tenantID)
+	}
+
 	return nil
 }
 
@@ -350,8 +712,213 @@ func (s *Service) GetFailedUndeliveredMessages(tenantID string, limit int) ([]*m
 	return messages, rows.Err()
 }
 
+// ListDeadLetter returns message dead-letter entries for tenantID that
+// exhausted their delivery retries, ordered by id for cursor pagination:
+// pass the highest id seen on the previous page as afterID, or 0 for the
+// first page.
+func (s *Service) ListDeadLetter(tenantID string, limit, afterID int) ([]*models.DeadLetterEntry, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	query := `
+		SELECT id, tenant_id, kind, ref_id, payload, last_error, attempts, created_at
+		FROM dead_letter
+		WHERE tenant_id = ? AND kind = 'message' AND id > ?
+		ORDER BY id ASC
+		LIMIT ?
+	`
+
+	rows, err := s.db.Query(query, tenantID, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead-letter messages: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []*models.DeadLetterEntry
+	for rows.Next() {
+		var e models.DeadLetterEntry
+		var lastError sql.NullString
+		err := rows.Scan(
+			&e.ID,
+			&e.TenantID,
+			&e.Kind,
+			&e.RefID,
+			&e.Payload,
+			&lastError,
+			&e.Attempts,
+			&e.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan dead-letter message: %w", err)
+		}
+		e.LastError = lastError.String
+		entries = append(entries, &e)
+	}
+
+	return entries, rows.Err()
+}
+
+// RequeueDeadLetter moves a message dead-letter entry of tenantID back onto
+// the undelivered_messages queue with its attempt count reset to 0, so the
+// delivery worker picks it up again on its next pass, then removes the
+// dead-letter entry.
+func (s *Service) RequeueDeadLetter(tenantID string, id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var payloadJSON string
+	err = tx.QueryRow(`
+		SELECT payload FROM dead_letter WHERE id = ? AND tenant_id = ? AND kind = 'message'
+	`, id, tenantID).Scan(&payloadJSON)
+	if err != nil {
+		return fmt.Errorf("failed to load dead-letter message: %w", err)
+	}
+
+	var payload struct {
+		UserID     string `json:"user_id"`
+		ChatroomID string `json:"chatroom_id"`
+		MessageID  string `json:"message_id"`
+		Seq        int    `json:"seq"`
+	}
+	if err := json.Unmarshal([]byte(payloadJSON), &payload); err != nil {
+		return fmt.Errorf("failed to decode dead-letter payload: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO undelivered_messages (tenant_id, user_id, chatroom_id, message_id, seq)
+		VALUES (?, ?, ?, ?, ?)
+	`, tenantID, payload.UserID, payload.ChatroomID, payload.MessageID, payload.Seq)
+	if err != nil {
+		return fmt.Errorf("failed to requeue undelivered message: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM dead_letter WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to remove dead-letter entry: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if s.waker != nil {
+		s.waker.WakeUp(tenantID)
+	}
+
+	return nil
+}
+
 // generateMessageID generates a unique message ID
 // In production, use crypto/rand or UUID library
 func generateMessageID() string {
 	return uuid.New().String()
 }
+
+// computeEventID derives a content-hash ID for a message, stable across
+// servers so a message relayed between federation peers (see
+// federation.Service) can be recognized as the same event rather than
+// mirrored twice, even though each server assigns it its own message_id and
+// seq.
+func computeEventID(tenantID, roomID, senderID, content, meta string, createdAt time.Time) string {
+	h := sha256.New()
+	h.Write([]byte(tenantID))
+	h.Write([]byte{0})
+	h.Write([]byte(roomID))
+	h.Write([]byte{0})
+	h.Write([]byte(senderID))
+	h.Write([]byte{0})
+	h.Write([]byte(content))
+	h.Write([]byte{0})
+	h.Write([]byte(meta))
+	h.Write([]byte{0})
+	h.Write([]byte(createdAt.UTC().Format(time.RFC3339Nano)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// nullableString converts an empty string to a SQL NULL, so an optional
+// column like messages.event_id stays NULL instead of "" for rows written
+// before federation existed - required for idx_messages_event_id's partial
+// uniqueness (WHERE event_id IS NOT NULL) to only apply to rows that have one.
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// InsertFederatedMessage mirrors a message relayed from a federation peer
+// directly into the local SQL mirror, preserving the sender's original
+// sender_id and seq instead of allocating a new one from this server's room
+// counter. It is deduplicated on (tenant_id, event_id), so a message
+// re-delivered after a retry is a no-op. Unlike SendMessage, the message
+// never passes through this room's own WAL: it already has a durable home on
+// the originating server, and giving it a second, independent WAL seq here
+// would conflict with the seq it's required to preserve.
+func (s *Service) InsertFederatedMessage(tenantID, roomID, eventID, senderID, content, meta string, seq int, createdAt time.Time) (*models.Message, error) {
+	messageID := generateMessageID()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var existingID string
+	err = tx.QueryRow(`SELECT message_id FROM messages WHERE tenant_id = ? AND event_id = ?`, tenantID, eventID).Scan(&existingID)
+	if err == nil {
+		// Release the transaction's connection first: the pool holds only
+		// one, and GetMessage needs it.
+		tx.Rollback()
+		return s.GetMessage(tenantID, existingID)
+	}
+	if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to check for duplicate federated message: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO messages (message_id, tenant_id, chatroom_id, sender_id, seq, content, meta, created_at, event_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, messageID, tenantID, roomID, senderID, seq, content, meta, createdAt, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert federated message: %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE rooms SET last_seq = ?, last_message_at = ? WHERE tenant_id = ? AND room_id = ? AND last_seq < ?
+	`, seq, createdAt, tenantID, roomID, seq); err != nil {
+		return nil, fmt.Errorf("failed to mirror room sequence: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit federated message: %w", err)
+	}
+
+	// Reconcile the in-memory counter the same way RecoverSequences does,
+	// so a room that's counter-resident (actively being posted to locally)
+	// doesn't keep handing out seqs below the federated value we just
+	// preserved, which would collide with it.
+	if rc, err := s.counterFor(tenantID, roomID); err != nil {
+		slog.Warn("Failed to reconcile room counter for federated message", "tenant_id", tenantID, "room_id", roomID, "error", err)
+	} else {
+		rc.mu.Lock()
+		if uint64(seq) > rc.seq {
+			rc.seq = uint64(seq)
+		}
+		rc.mu.Unlock()
+	}
+
+	return &models.Message{
+		MessageID:  messageID,
+		TenantID:   tenantID,
+		ChatroomID: roomID,
+		SenderID:   senderID,
+		Seq:        seq,
+		Content:    content,
+		Meta:       meta,
+		CreatedAt:  createdAt,
+		EventID:    eventID,
+	}, nil
+}
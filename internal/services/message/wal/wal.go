@@ -0,0 +1,333 @@
+// Package wal is a durable, append-only log of chat messages per (tenant,
+// room), backed by tidwall/wal and msgpack-encoded entries - the same
+// building block topiclog uses for notification topics. It lets
+// message.Service allocate sequence numbers and persist a message without
+// taking a SQL writer transaction on the hot path; see message.Service's
+// doc comment for how writes are mirrored into SQLite afterwards.
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/wal"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// defaultSegmentSize rotates a room's log to a new segment file every 16MiB,
+// so a long-lived high-traffic room doesn't grow one unbounded file.
+const defaultSegmentSize = 16 * 1024 * 1024
+
+// Entry is a single message record read back from a room's log.
+type Entry struct {
+	Seq       uint64    `msgpack:"seq"`
+	MessageID string    `msgpack:"message_id"`
+	SenderID  string    `msgpack:"sender_id"`
+	Content   string    `msgpack:"content"`
+	Meta      string    `msgpack:"meta"`
+	CreatedAt time.Time `msgpack:"created_at"`
+	// EventID is omitted (empty) for entries written before federation
+	// added it; msgpack's default map-keyed struct encoding decodes those
+	// old entries into a zero-value string here instead of failing.
+	EventID string `msgpack:"event_id,omitempty"`
+}
+
+// RoomSeq pairs a (tenant, room) with the highest sequence recovered from
+// its on-disk log, returned by Recover.
+type RoomSeq struct {
+	TenantID string
+	RoomID   string
+	LastSeq  uint64
+}
+
+// Log manages one WAL per (tenant, room), opened lazily on first use and
+// kept open for the lifetime of the process.
+type Log struct {
+	baseDir     string
+	segmentSize int
+
+	mu    sync.Mutex
+	opens map[string]*wal.Log
+}
+
+// New creates a Log that stores its WAL segments under baseDir, one
+// subdirectory per (tenant, room), rotating segments at defaultSegmentSize.
+func New(baseDir string) *Log {
+	return NewWithSegmentSize(baseDir, defaultSegmentSize)
+}
+
+// NewWithSegmentSize is New with an explicit segment rotation size, mainly
+// for tests that want small segments.
+func NewWithSegmentSize(baseDir string, segmentSize int) *Log {
+	return &Log{baseDir: baseDir, segmentSize: segmentSize, opens: make(map[string]*wal.Log)}
+}
+
+// dirFor returns the on-disk directory for a (tenant, room) pair. Both are
+// expected to be API-supplied identifiers, not filesystem paths, so they are
+// escaped rather than joined directly.
+func (l *Log) dirFor(tenantID, roomID string) string {
+	return filepath.Join(l.baseDir, escape(tenantID), escape(roomID))
+}
+
+// escape makes s safe to use as a single path component.
+func escape(s string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", "..", "__").Replace(s)
+}
+
+func (l *Log) key(tenantID, roomID string) string {
+	return tenantID + "|" + roomID
+}
+
+// open returns the WAL for (tenantID, roomID), opening it on first access.
+func (l *Log) open(tenantID, roomID string) (*wal.Log, error) {
+	key := l.key(tenantID, roomID)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if w, ok := l.opens[key]; ok {
+		return w, nil
+	}
+
+	dir := l.dirFor(tenantID, roomID)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create message log directory: %w", err)
+	}
+
+	opts := *wal.DefaultOptions
+	opts.SegmentSize = l.segmentSize
+	w, err := wal.Open(dir, &opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open message log: %w", err)
+	}
+
+	l.opens[key] = w
+	return w, nil
+}
+
+// Append writes e to (tenantID, roomID)'s log at w.LastIndex()+1, the only
+// index tidwall/wal accepts: it requires every write to continue the log
+// without gaps, so it can't hold e.Seq directly once e.Seq has been seeded
+// from somewhere other than this log's own tail (rooms.last_seq recovered
+// on upgrade, or bumped by federation without a matching local append). The
+// caller's logical seq - allocated from its own per-room counter, unlike
+// topiclog where this package owns allocation - travels inside e instead,
+// and is recovered by scanning entries rather than by WAL index.
+func (l *Log) Append(tenantID, roomID string, e Entry) error {
+	w, err := l.open(tenantID, roomID)
+	if err != nil {
+		return err
+	}
+
+	data, err := msgpack.Marshal(&e)
+	if err != nil {
+		return fmt.Errorf("failed to encode message log entry: %w", err)
+	}
+
+	last, err := w.LastIndex()
+	if err != nil {
+		return fmt.Errorf("failed to read message log tail: %w", err)
+	}
+
+	if err := w.Write(last+1, data); err != nil {
+		return fmt.Errorf("failed to append to message log: %w", err)
+	}
+	return nil
+}
+
+// seqAt reads and decodes the entry at WAL index idx, returning its logical
+// Seq.
+func (l *Log) seqAt(w *wal.Log, idx uint64) (uint64, error) {
+	data, err := w.Read(idx)
+	if err != nil {
+		return 0, err
+	}
+	var e Entry
+	if err := msgpack.Unmarshal(data, &e); err != nil {
+		return 0, err
+	}
+	return e.Seq, nil
+}
+
+// indexAfter returns the smallest WAL index in [first, last] whose entry's
+// Seq is greater than fromSeq, or last+1 if every entry's Seq is <= fromSeq.
+// It assumes Seq grows strictly with index, which holds because Append is
+// only ever called with the next seq from the room's counter.
+func (l *Log) indexAfter(w *wal.Log, first, last, fromSeq uint64) (uint64, error) {
+	lo, hi := first, last+1
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		seq, err := l.seqAt(w, mid)
+		if err != nil {
+			return 0, err
+		}
+		if seq > fromSeq {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo, nil
+}
+
+// Read returns up to limit entries from (tenantID, roomID) with Seq >
+// fromSeq, in order. It stops early, without error, once it reaches the
+// log's tail.
+func (l *Log) Read(tenantID, roomID string, fromSeq uint64, limit int) ([]Entry, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	w, err := l.open(tenantID, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := w.FirstIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message log head: %w", err)
+	}
+	last, err := w.LastIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message log tail: %w", err)
+	}
+	if last == 0 {
+		return nil, nil
+	}
+
+	start, err := l.indexAfter(w, first, last, fromSeq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate message log entry after seq %d: %w", fromSeq, err)
+	}
+
+	var entries []Entry
+	for idx := start; idx <= last && len(entries) < limit; idx++ {
+		data, err := w.Read(idx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message log entry %d: %w", idx, err)
+		}
+		var e Entry
+		if err := msgpack.Unmarshal(data, &e); err != nil {
+			return nil, fmt.Errorf("failed to decode message log entry %d: %w", idx, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// LastSeq returns the most recently appended sequence number for
+// (tenantID, roomID), or 0 if the room has never been written to.
+func (l *Log) LastSeq(tenantID, roomID string) (uint64, error) {
+	w, err := l.open(tenantID, roomID)
+	if err != nil {
+		return 0, err
+	}
+	last, err := w.LastIndex()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read message log tail: %w", err)
+	}
+	if last == 0 {
+		return 0, nil
+	}
+	return l.seqAt(w, last)
+}
+
+// Truncate drops every entry at or before minSeq from (tenantID, roomID)'s
+// log, except the newest entry, which is always kept even when its seq is
+// at or before minSeq. minSeq is typically the minimum last_ack across the room's members,
+// so nothing still-unacknowledged is ever dropped.
+func (l *Log) Truncate(tenantID, roomID string, minSeq uint64) error {
+	if minSeq == 0 {
+		return nil
+	}
+
+	w, err := l.open(tenantID, roomID)
+	if err != nil {
+		return err
+	}
+
+	first, err := w.FirstIndex()
+	if err != nil {
+		return fmt.Errorf("failed to read message log head: %w", err)
+	}
+	last, err := w.LastIndex()
+	if err != nil {
+		return fmt.Errorf("failed to read message log tail: %w", err)
+	}
+	if last == 0 {
+		return nil
+	}
+
+	newFront, err := l.indexAfter(w, first, last, minSeq)
+	if err != nil {
+		return fmt.Errorf("failed to locate message log truncation point: %w", err)
+	}
+	if newFront > last {
+		newFront = last
+	}
+
+	if err := w.TruncateFront(newFront); err != nil && err != wal.ErrOutOfRange {
+		return fmt.Errorf("failed to truncate message log: %w", err)
+	}
+	return nil
+}
+
+// Recover walks baseDir and returns the last sequence number found on disk
+// for every (tenant, room) it has ever written to, so a restarted process
+// can reconcile rooms.last_seq (and its in-memory counters) with whatever
+// actually made it to the log, even if the SQLite mirror of a tail write
+// never landed.
+func (l *Log) Recover() ([]RoomSeq, error) {
+	tenantDirs, err := os.ReadDir(l.baseDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list message log directory: %w", err)
+	}
+
+	var recovered []RoomSeq
+	for _, td := range tenantDirs {
+		if !td.IsDir() {
+			continue
+		}
+		tenantID := td.Name()
+
+		roomDirs, err := os.ReadDir(filepath.Join(l.baseDir, tenantID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list message log directory for tenant %s: %w", tenantID, err)
+		}
+		for _, rd := range roomDirs {
+			if !rd.IsDir() {
+				continue
+			}
+			roomID := rd.Name()
+
+			lastSeq, err := l.LastSeq(tenantID, roomID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to recover message log for tenant %s room %s: %w", tenantID, roomID, err)
+			}
+			recovered = append(recovered, RoomSeq{TenantID: tenantID, RoomID: roomID, LastSeq: lastSeq})
+		}
+	}
+	return recovered, nil
+}
+
+// Close closes every WAL this Log has opened.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var firstErr error
+	for key, w := range l.opens {
+		if err := w.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to close message log %s: %w", key, err)
+		}
+	}
+	l.opens = make(map[string]*wal.Log)
+	return firstErr
+}
@@ -7,21 +7,61 @@ import (
 	"log/slog"
 	"time"
 
-	"github.com/Byabasaija/chatapi/internal/models"
 	"github.com/google/uuid"
+	"github.com/hastenr/chatapi/internal/models"
+	"github.com/hastenr/chatapi/internal/pubsub"
+	"github.com/hastenr/chatapi/internal/retry"
+	"github.com/hastenr/chatapi/internal/topiclog"
 )
 
+// Waker is notified whenever new work is inserted so a long-polling worker
+// can wake up immediately instead of waiting for its next tick.
+type Waker interface {
+	WakeUp(tenantID string)
+}
+
+// defaultRetryPolicy is used until SetRetryPolicy is called with values from
+// config.Config.
+var defaultRetryPolicy = retry.Policy{
+	MaxAttempts:  5,
+	BaseInterval: 30 * time.Second,
+	MaxBackoff:   1 * time.Hour,
+	Jitter:       0.2,
+}
+
 // Service handles durable notifications
 type Service struct {
-	db *sql.DB
+	db          *sql.DB
+	bus         *pubsub.Bus
+	topics      *topiclog.Log
+	waker       Waker
+	retryPolicy retry.Policy
 }
 
-// NewService creates a new notification service
-func NewService(db *sql.DB) *Service {
-	return &Service{db: db}
+// NewService creates a new notification service. bus may be nil, in which
+// case notification events are not published. topics is the per-topic WAL
+// that backs CreateNotification's append and every subscriber's replay; see
+// topiclog's doc comment.
+func NewService(db *sql.DB, bus *pubsub.Bus, topics *topiclog.Log) *Service {
+	return &Service{db: db, bus: bus, topics: topics, retryPolicy: defaultRetryPolicy}
 }
 
-// CreateNotification creates a new durable notification
+// SetWaker registers a Waker to be notified after notifications are created
+func (s *Service) SetWaker(w Waker) {
+	s.waker = w
+}
+
+// SetRetryPolicy overrides the exponential backoff policy used by
+// MarkNotificationFailed
+func (s *Service) SetRetryPolicy(p retry.Policy) {
+	s.retryPolicy = p
+}
+
+// CreateNotification creates a new durable notification: it is appended to
+// its topic's topiclog WAL first (the durable, ordered record subscribers
+// replay from), then recorded in the notifications table at the topic_seq
+// the append was assigned, so dead-letter/retry bookkeeping keeps working
+// exactly as before topics had a WAL.
 func (s *Service) CreateNotification(tenantID string, req *models.CreateNotificationRequest) (*models.Notification, error) {
 	// Generate notification ID
 	notificationID := generateNotificationID()
@@ -32,13 +72,18 @@ func (s *Service) CreateNotification(tenantID string, req *models.CreateNotifica
 		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
+	topicSeq, err := s.topics.Append(tenantID, req.Topic, payloadJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to append to topic log: %w", err)
+	}
+
 	// Insert notification
 	query := `
-		INSERT INTO notifications (notification_id, tenant_id, topic, payload, status)
-		VALUES (?, ?, ?, ?, 'pending')
+		INSERT INTO notifications (notification_id, tenant_id, topic, payload, status, topic_seq)
+		VALUES (?, ?, ?, ?, 'pending', ?)
 	`
 
-	_, err = s.db.Exec(query, notificationID, tenantID, req.Topic, string(payloadJSON))
+	_, err = s.db.Exec(query, notificationID, tenantID, req.Topic, string(payloadJSON), topicSeq)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create notification: %w", err)
 	}
@@ -51,12 +96,22 @@ func (s *Service) CreateNotification(tenantID string, req *models.CreateNotifica
 		Status:         "pending",
 		Attempts:       0,
 		CreatedAt:      time.Now(),
+		TopicSeq:       int64(topicSeq),
 	}
 
 	slog.Info("Created notification",
 		"tenant_id", tenantID,
 		"notification_id", notificationID,
-		"topic", req.Topic)
+		"topic", req.Topic,
+		"topic_seq", topicSeq)
+
+	if s.bus != nil {
+		s.bus.Publish(tenantID, "notification.created", notification)
+	}
+
+	if s.waker != nil {
+		s.waker.WakeUp(tenantID)
+	}
 
 	return notification, nil
 }
@@ -71,6 +126,7 @@ func (s *Service) GetPendingNotifications(tenantID string, limit int) ([]*models
 		SELECT notification_id, tenant_id, topic, payload, created_at, status, attempts, last_attempt_at
 		FROM notifications
 		WHERE tenant_id = ? AND status IN ('pending', 'processing')
+			AND (next_retry_at IS NULL OR next_retry_at <= CURRENT_TIMESTAMP)
 		ORDER BY created_at ASC
 		LIMIT ?
 	`
@@ -119,24 +175,64 @@ func (s *Service) MarkNotificationDelivered(notificationID string) error {
 	return nil
 }
 
-// MarkNotificationFailed marks a notification as failed and increments attempts
-func (s *Service) MarkNotificationFailed(notificationID string) error {
+// MarkNotificationFailed marks a notification as failed, schedules its next
+// retry with exponential backoff + jitter, and moves it to the dead letter
+// table once it exhausts its attempts.
+func (s *Service) MarkNotificationFailed(notificationID, lastErr string) error {
+	var attempts int
+	var payload string
+	err := s.db.QueryRow(`SELECT attempts, payload FROM notifications WHERE notification_id = ?`, notificationID).Scan(&attempts, &payload)
+	if err != nil {
+		return fmt.Errorf("failed to load notification: %w", err)
+	}
+
+	if s.retryPolicy.IsTerminal(attempts) {
+		return s.moveToDeadLetter(notificationID, payload, attempts+1, lastErr)
+	}
+
+	nextRetryAt := s.retryPolicy.NextRetryAt(attempts, time.Now())
 	query := `
 		UPDATE notifications
-		SET status = CASE WHEN attempts >= 4 THEN 'dead' ELSE 'pending' END,
+		SET status = 'pending',
 			attempts = attempts + 1,
-			last_attempt_at = CURRENT_TIMESTAMP
+			last_attempt_at = CURRENT_TIMESTAMP,
+			next_retry_at = ?,
+			last_error = ?
 		WHERE notification_id = ?
 	`
 
-	_, err := s.db.Exec(query, notificationID)
-	if err != nil {
+	if _, err := s.db.Exec(query, nextRetryAt, lastErr, notificationID); err != nil {
 		return fmt.Errorf("failed to mark notification failed: %w", err)
 	}
 
 	return nil
 }
 
+// moveToDeadLetter marks a notification dead and records it for operator
+// inspection/requeue
+func (s *Service) moveToDeadLetter(notificationID, payload string, attempts int, lastErr string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE notifications SET status = 'dead', attempts = ?, last_attempt_at = CURRENT_TIMESTAMP, last_error = ? WHERE notification_id = ?`,
+		attempts, lastErr, notificationID)
+	if err != nil {
+		return fmt.Errorf("failed to mark notification dead: %w", err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO dead_letter (tenant_id, kind, ref_id, payload, last_error, attempts)
+		SELECT tenant_id, 'notification', notification_id, payload, ?, ? FROM notifications WHERE notification_id = ?`,
+		lastErr, attempts, notificationID)
+	if err != nil {
+		return fmt.Errorf("failed to insert dead letter entry: %w", err)
+	}
+
+	return tx.Commit()
+}
+
 // GetNotificationSubscribers gets subscribers for a topic
 func (s *Service) GetNotificationSubscribers(tenantID, topic string) ([]*models.NotificationSubscription, error) {
 	query := `
@@ -172,6 +268,165 @@ func (s *Service) GetNotificationSubscribers(tenantID, topic string) ([]*models.
 	return subscribers, nil
 }
 
+// GetInAppSubscriptions returns every subscription for tenantID whose
+// endpoint is blank, i.e. a WebSocket/in-app subscriber rather than a
+// webhook (webhook subscriptions are pumped by webhook.Service instead; see
+// delivery.Service.ProcessNotifications).
+func (s *Service) GetInAppSubscriptions(tenantID string) ([]*models.NotificationSubscription, error) {
+	query := `
+		SELECT id, tenant_id, subscriber_id, topic, endpoint, metadata, created_at
+		FROM notification_subscriptions
+		WHERE tenant_id = ? AND endpoint = ''
+	`
+
+	rows, err := s.db.Query(query, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get in-app subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var subscribers []*models.NotificationSubscription
+	for rows.Next() {
+		var sub models.NotificationSubscription
+		err := rows.Scan(
+			&sub.ID,
+			&sub.TenantID,
+			&sub.SubscriberID,
+			&sub.Topic,
+			&sub.Endpoint,
+			&sub.Metadata,
+			&sub.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan subscriber: %w", err)
+		}
+		subscribers = append(subscribers, &sub)
+	}
+
+	return subscribers, nil
+}
+
+// ListSubscribedTopics returns the distinct topics tenantID has at least one
+// subscriber on, for CleanupOldEntries to know which topic logs to consider
+// truncating.
+func (s *Service) ListSubscribedTopics(tenantID string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT topic FROM notification_subscriptions WHERE tenant_id = ?`, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subscribed topics: %w", err)
+	}
+	defer rows.Close()
+
+	var topics []string
+	for rows.Next() {
+		var topic string
+		if err := rows.Scan(&topic); err != nil {
+			return nil, fmt.Errorf("failed to scan topic: %w", err)
+		}
+		topics = append(topics, topic)
+	}
+	return topics, rows.Err()
+}
+
+// TruncateTopic drops every entry at or before the minimum committed cursor
+// across topic's live subscribers from its topiclog WAL. It is a no-op if
+// the topic has no subscribers, since there is then no safe floor to
+// truncate to.
+func (s *Service) TruncateTopic(tenantID, topic string) error {
+	minSeq, ok, err := s.MinCommittedCursor(tenantID, topic)
+	if err != nil || !ok {
+		return err
+	}
+	return s.topics.Truncate(tenantID, topic, minSeq)
+}
+
+// ReadTopic reads up to limit topiclog entries for tenantID/topic with
+// Seq > fromSeq, for HTTP catch-up (GET /topics/{topic}/messages) and
+// WebSocket subscribe/replay.
+func (s *Service) ReadTopic(tenantID, topic string, fromSeq uint64, limit int) ([]*models.TopicMessage, error) {
+	entries, err := s.topics.Read(tenantID, topic, fromSeq, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read topic log: %w", err)
+	}
+
+	messages := make([]*models.TopicMessage, len(entries))
+	for i, e := range entries {
+		messages[i] = &models.TopicMessage{Topic: topic, Seq: e.Seq, Payload: json.RawMessage(e.Payload)}
+	}
+	return messages, nil
+}
+
+// Subscribe records subscriberID as a live subscriber of tenantID/topic (a
+// no-op if it already is) so the delivery pump and truncation know about it,
+// and returns its current committed cursor (0 if this is its first
+// subscribe) for the caller to replay from.
+func (s *Service) Subscribe(tenantID, topic, subscriberID string) (uint64, error) {
+	_, err := s.db.Exec(`
+		INSERT OR IGNORE INTO notification_subscriptions (tenant_id, subscriber_id, topic, endpoint)
+		VALUES (?, ?, ?, '')
+	`, tenantID, subscriberID, topic)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record subscription: %w", err)
+	}
+
+	return s.GetCursor(tenantID, topic, subscriberID)
+}
+
+// GetCursor returns subscriberID's committed sequence for tenantID/topic, or
+// 0 if it has never committed one.
+func (s *Service) GetCursor(tenantID, topic, subscriberID string) (uint64, error) {
+	var seq uint64
+	err := s.db.QueryRow(`
+		SELECT committed_seq FROM topic_cursors WHERE tenant_id = ? AND topic = ? AND subscriber_id = ?
+	`, tenantID, topic, subscriberID).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to load cursor: %w", err)
+	}
+	return seq, nil
+}
+
+// CommitCursor advances subscriberID's committed sequence for tenantID/topic
+// to seq, marking everything up to and including seq as delivered to it.
+func (s *Service) CommitCursor(tenantID, topic, subscriberID string, seq uint64) error {
+	_, err := s.db.Exec(`
+		INSERT INTO topic_cursors (tenant_id, topic, subscriber_id, committed_seq, updated_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (tenant_id, topic, subscriber_id)
+		DO UPDATE SET committed_seq = excluded.committed_seq, updated_at = excluded.updated_at
+		WHERE excluded.committed_seq > topic_cursors.committed_seq
+	`, tenantID, topic, subscriberID, seq)
+	if err != nil {
+		return fmt.Errorf("failed to commit cursor: %w", err)
+	}
+	return nil
+}
+
+// MinCommittedCursor returns the lowest committed_seq across every live
+// subscriber of tenantID/topic (0 for a subscriber that has never
+// committed - see Subscribe, which records the subscription before any
+// topic_cursors row exists for it), and false if the topic has no
+// subscribers, in which case truncation must not assume anything has been
+// read.
+func (s *Service) MinCommittedCursor(tenantID, topic string) (uint64, bool, error) {
+	var seq sql.NullInt64
+	err := s.db.QueryRow(`
+		SELECT MIN(COALESCE(tc.committed_seq, 0))
+		FROM notification_subscriptions ns
+		LEFT JOIN topic_cursors tc
+			ON tc.tenant_id = ns.tenant_id AND tc.topic = ns.topic AND tc.subscriber_id = ns.subscriber_id
+		WHERE ns.tenant_id = ? AND ns.topic = ?
+	`, tenantID, topic).Scan(&seq)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to compute minimum committed cursor: %w", err)
+	}
+	if !seq.Valid {
+		return 0, false, nil
+	}
+	return uint64(seq.Int64), true, nil
+}
+
 // generateNotificationID generates a unique notification ID
 func generateNotificationID() string {
 	return uuid.New().String()
@@ -0,0 +1,341 @@
+package realtime
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/hastenr/chatapi/internal/broker"
+)
+
+// MessageEvent is the envelope published on a room's subject when a message
+// is committed, so every node in the cluster can deliver it to whichever of
+// its target_user_ids are connected locally.
+type MessageEvent struct {
+	TenantID      string   `json:"tenant_id"`
+	RoomID        string   `json:"room_id"`
+	MessageID     string   `json:"message_id"`
+	Seq           int64    `json:"seq"`
+	TargetUserIDs []string `json:"target_user_ids"`
+}
+
+// AckEvent is the envelope published on a room's subject when a delivery ack
+// is recorded, mirroring MessageEvent so other nodes' room members see it.
+type AckEvent struct {
+	TenantID string `json:"tenant_id"`
+	RoomID   string `json:"room_id"`
+	UserID   string `json:"user_id"`
+	Seq      int    `json:"seq"`
+}
+
+// PresenceEvent is the envelope published on a user's presence subject when
+// their online/offline status changes on this node.
+type PresenceEvent struct {
+	TenantID     string `json:"tenant_id"`
+	UserID       string `json:"user_id"`
+	Status       string `json:"status"`
+	OriginNodeID string `json:"origin_node_id"`
+}
+
+// roomSubject and presenceSubject are the dotted subjects events are
+// published/subscribed on; see internal/broker's doc comment for the
+// wildcard rules a subscription pattern like "chatapi.*.room.>" follows.
+func roomSubject(tenantID, roomID string) string {
+	return fmt.Sprintf("chatapi.%s.room.%s", tenantID, roomID)
+}
+
+func presenceSubject(tenantID, userID string) string {
+	return fmt.Sprintf("chatapi.%s.presence.%s", tenantID, userID)
+}
+
+const (
+	roomSubjectPattern     = "chatapi.*.room.>"
+	presenceSubjectPattern = "chatapi.*.presence.*"
+
+	// healthSubject is a reserved subject Healthy uses only to probe that
+	// this node's broker can still publish; nothing subscribes to it.
+	healthSubject = "chatapi._health"
+)
+
+// Backplane fans messages, acks, and presence changes out to every node in
+// the cluster via a broker.Broker, and heartbeats this node's presence rows
+// so that IsUserOnline/GetOnlineUsers can eventually be answered
+// cluster-wide.
+//
+// This started (chunk1-3) as a Postgres LISTEN/NOTIFY backplane riding the
+// in-process pubsub.Bus instead, since this repo's storage is SQLite with a
+// single writer and there was no Postgres to LISTEN/NOTIFY on. broker.Broker
+// generalizes that: NewInProcess() preserves that original single-node
+// behavior, and broker.NewNATS (behind the "nats" build tag) lets a real
+// cluster share delivery and presence across nodes sitting behind a
+// load balancer with no sticky sessions, without this file changing.
+//
+// A message or ack this node already handed to its own local connections
+// (via Service.BroadcastToRoom, before the matching PublishMessageEvent /
+// PublishAckEvent call) would otherwise be handed to those same connections
+// a second time when this node's own subscription receives its own publish.
+// markDelivered/alreadyDelivered close that loop: the publishing call marks
+// its dedupe key first, and the subscription handler skips any key it finds
+// already marked, so only sibling nodes actually relay the event locally.
+type Backplane struct {
+	db     *sql.DB
+	broker broker.Broker
+	svc    *Service
+	nodeID string
+
+	dedupeMu sync.Mutex
+	dedupe   map[string]time.Time
+}
+
+// NewBackplane creates a Backplane for svc, publishing and consuming events
+// on b and heartbeating presence to db under nodeID.
+func NewBackplane(db *sql.DB, b broker.Broker, svc *Service, nodeID string) *Backplane {
+	return &Backplane{db: db, broker: b, svc: svc, nodeID: nodeID, dedupe: make(map[string]time.Time)}
+}
+
+// markDelivered records that dedupeKey was already delivered to this node's
+// local connections, so the echo of the publish that follows is skipped by
+// alreadyDelivered. One-shot: the first alreadyDelivered check consumes it.
+func (b *Backplane) markDelivered(dedupeKey string) {
+	b.dedupeMu.Lock()
+	b.dedupe[dedupeKey] = time.Now()
+	b.dedupeMu.Unlock()
+}
+
+func (b *Backplane) alreadyDelivered(dedupeKey string) bool {
+	b.dedupeMu.Lock()
+	defer b.dedupeMu.Unlock()
+	if _, ok := b.dedupe[dedupeKey]; ok {
+		delete(b.dedupe, dedupeKey)
+		return true
+	}
+	return false
+}
+
+// cleanupDedupe evicts dedupe keys that were never echoed back (the broker
+// dropped the publish, or delivery raced an unsubscribe), so a quiet node
+// doesn't leak memory over time.
+func (b *Backplane) cleanupDedupe() {
+	cutoff := time.Now().Add(-2 * heartbeatInterval)
+	b.dedupeMu.Lock()
+	for key, at := range b.dedupe {
+		if at.Before(cutoff) {
+			delete(b.dedupe, key)
+		}
+	}
+	b.dedupeMu.Unlock()
+}
+
+// PublishMessageEvent announces a committed message to every node listening
+// on its room's subject, including this one. Call this after the message
+// row (and its seq) have been committed and after this node's own local
+// fanout, so markDelivered's key is in place before the echo arrives.
+func (b *Backplane) PublishMessageEvent(event MessageEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal message event: %w", err)
+	}
+	b.markDelivered(messageDedupeKey(event.TenantID, event.RoomID, event.Seq))
+	return b.broker.Publish(roomSubject(event.TenantID, event.RoomID), data)
+}
+
+// PublishAckEvent announces a recorded delivery ack to every node listening
+// on its room's subject, mirroring PublishMessageEvent.
+func (b *Backplane) PublishAckEvent(event AckEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal ack event: %w", err)
+	}
+	b.markDelivered(ackDedupeKey(event.TenantID, event.RoomID, event.UserID, event.Seq))
+	return b.broker.Publish(roomSubject(event.TenantID, event.RoomID), data)
+}
+
+// PublishPresenceEvent announces a presence change to every node listening
+// on userID's presence subject.
+func (b *Backplane) PublishPresenceEvent(event PresenceEvent) error {
+	event.OriginNodeID = b.nodeID
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal presence event: %w", err)
+	}
+	return b.broker.Publish(presenceSubject(event.TenantID, event.UserID), data)
+}
+
+// Healthy reports whether this node's broker can still publish, by probing
+// it with an empty payload on a reserved subject nothing subscribes to.
+// Service.BrokerHealthy surfaces this as "broker_connected" on GET
+// /health?verbose=1, so a silently-dropped NATS/Redis connection shows up
+// instead of looking identical to a quiet one.
+func (b *Backplane) Healthy() bool {
+	return b.broker.Publish(healthSubject, nil) == nil
+}
+
+func messageDedupeKey(tenantID, roomID string, seq int64) string {
+	return fmt.Sprintf("msg|%s|%s|%d", tenantID, roomID, seq)
+}
+
+func ackDedupeKey(tenantID, roomID, userID string, seq int) string {
+	return fmt.Sprintf("ack|%s|%s|%s|%d", tenantID, roomID, userID, seq)
+}
+
+// Start subscribes to room and presence subjects and begins heartbeating
+// presence until ctx is canceled.
+func (b *Backplane) Start(ctx context.Context) error {
+	unsubRoom, err := b.broker.Subscribe(roomSubjectPattern, b.handleRoomEvent)
+	if err != nil {
+		return fmt.Errorf("subscribe room events: %w", err)
+	}
+	unsubPresence, err := b.broker.Subscribe(presenceSubjectPattern, b.handlePresenceEvent)
+	if err != nil {
+		unsubRoom()
+		return fmt.Errorf("subscribe presence events: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		unsubRoom()
+		unsubPresence()
+	}()
+
+	go b.heartbeatLoop(ctx)
+	return nil
+}
+
+// handleRoomEvent dispatches a payload received on a room subject to
+// whichever of MessageEvent or AckEvent it decodes as. Both share the same
+// subject so that a reconnecting node only needs one subscription per room.
+func (b *Backplane) handleRoomEvent(payload []byte) {
+	var envelope struct {
+		MessageID string `json:"message_id"`
+		UserID    string `json:"user_id"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		slog.Warn("Backplane received malformed room event", "error", err)
+		return
+	}
+
+	if envelope.MessageID != "" {
+		var msgEvent MessageEvent
+		if err := json.Unmarshal(payload, &msgEvent); err != nil {
+			slog.Warn("Backplane received malformed message event", "error", err)
+			return
+		}
+		b.handleMessageEvent(msgEvent)
+		return
+	}
+
+	var ackEvent AckEvent
+	if err := json.Unmarshal(payload, &ackEvent); err != nil {
+		slog.Warn("Backplane received malformed ack event", "error", err)
+		return
+	}
+	b.handleAckEvent(ackEvent)
+}
+
+func (b *Backplane) handleMessageEvent(msgEvent MessageEvent) {
+	if b.alreadyDelivered(messageDedupeKey(msgEvent.TenantID, msgEvent.RoomID, msgEvent.Seq)) {
+		return
+	}
+
+	payload := map[string]interface{}{
+		"type":       "message.new",
+		"room_id":    msgEvent.RoomID,
+		"message_id": msgEvent.MessageID,
+		"seq":        msgEvent.Seq,
+	}
+	for _, userID := range msgEvent.TargetUserIDs {
+		if b.svc.IsUserOnline(msgEvent.TenantID, userID) {
+			b.svc.SendToUser(msgEvent.TenantID, userID, payload)
+		}
+	}
+}
+
+func (b *Backplane) handleAckEvent(ackEvent AckEvent) {
+	if b.alreadyDelivered(ackDedupeKey(ackEvent.TenantID, ackEvent.RoomID, ackEvent.UserID, ackEvent.Seq)) {
+		return
+	}
+
+	b.svc.BroadcastToRoom(ackEvent.TenantID, ackEvent.RoomID, map[string]interface{}{
+		"type":    "ack.received",
+		"room_id": ackEvent.RoomID,
+		"seq":     ackEvent.Seq,
+		"user_id": ackEvent.UserID,
+	})
+}
+
+// handlePresenceEvent relays a presence change from another node to this
+// node's local connections. Events this node originated are skipped - it
+// already ran broadcastPresenceUpdate locally before publishing.
+func (b *Backplane) handlePresenceEvent(payload []byte) {
+	var presenceEvent PresenceEvent
+	if err := json.Unmarshal(payload, &presenceEvent); err != nil {
+		slog.Warn("Backplane received malformed presence event", "error", err)
+		return
+	}
+	if presenceEvent.OriginNodeID == b.nodeID {
+		return
+	}
+	b.svc.broadcastPresenceUpdate(presenceEvent.TenantID, presenceEvent.UserID, presenceEvent.Status)
+}
+
+// heartbeatInterval controls how often this node refreshes its presence
+// rows and sweeps its dedupe cache; presenceTTL must stay comfortably larger
+// so a brief stall doesn't make the node look offline to itself.
+const (
+	heartbeatInterval = 30 * time.Second
+	presenceTTL       = 90 * time.Second
+)
+
+func (b *Backplane) heartbeatLoop(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.heartbeat()
+			b.cleanupDedupe()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// heartbeat upserts a presence row per (tenant, user) this node currently
+// has a live connection for, with expires_at pushed out by presenceTTL.
+func (b *Backplane) heartbeat() {
+	now := time.Now()
+	expiresAt := now.Add(presenceTTL)
+
+	b.svc.mu.RLock()
+	type key struct{ tenantID, userID string }
+	var online []key
+	for tenantID, users := range b.svc.connections {
+		for userID, conns := range users {
+			if len(conns) > 0 {
+				online = append(online, key{tenantID, userID})
+			}
+		}
+	}
+	b.svc.mu.RUnlock()
+
+	for _, k := range online {
+		_, err := b.db.Exec(`
+			INSERT INTO presence (tenant_id, user_id, node_id, expires_at, updated_at)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (tenant_id, user_id, node_id)
+			DO UPDATE SET expires_at = excluded.expires_at, updated_at = excluded.updated_at
+		`, k.tenantID, k.userID, b.nodeID, expiresAt, now)
+		if err != nil {
+			slog.Error("Failed to heartbeat presence", "tenant_id", k.tenantID, "user_id", k.userID, "error", err)
+		}
+	}
+
+	if _, err := b.db.Exec(`DELETE FROM presence WHERE node_id = ? AND expires_at < ?`, b.nodeID, now); err != nil {
+		slog.Error("Failed to prune stale presence rows", "node_id", b.nodeID, "error", err)
+	}
+}
@@ -0,0 +1,190 @@
+package realtime
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec converts between application values and the bytes sent on a
+// WebSocket connection, so the wire format (JSON text today, MessagePack
+// and/or compression for clients that negotiate it) is decided once per
+// connection rather than hardcoded at every call site that writes to one.
+type Codec interface {
+	// Encode serializes v and reports which WebSocket message type
+	// (websocket.TextMessage or websocket.BinaryMessage) it must be sent
+	// as.
+	Encode(v any) ([]byte, int, error)
+	// Decode deserializes data received as the given WebSocket message
+	// type into a generic value (typically map[string]interface{}).
+	Decode(data []byte, messageType int) (any, error)
+}
+
+// Subprotocol name constants negotiated over Sec-WebSocket-Protocol.
+// "-br" suffixed protocols additionally brotli-compress payloads at or
+// above the compressionThreshold passed to CodecForSubprotocol; see
+// newCompressingCodec.
+const (
+	SubprotocolJSON          = "chatapi.v1+json"
+	SubprotocolMsgpack       = "chatapi.v1+msgpack"
+	SubprotocolMsgpackBrotli = "chatapi.v1+msgpack-br"
+)
+
+// SupportedSubprotocols lists every subprotocol CodecForSubprotocol
+// recognizes, in preference order, for use as websocket.Upgrader's
+// Subprotocols field.
+var SupportedSubprotocols = []string{SubprotocolMsgpackBrotli, SubprotocolMsgpack, SubprotocolJSON}
+
+// CodecForSubprotocol returns the Codec for a negotiated subprotocol name
+// (as returned by (*websocket.Conn).Subprotocol()), defaulting to JSON for
+// an empty or unrecognized name so clients that don't negotiate one keep
+// working exactly as before this feature existed.
+func CodecForSubprotocol(subprotocol string, compressionThreshold int) Codec {
+	switch subprotocol {
+	case SubprotocolMsgpack:
+		return msgpackCodec{}
+	case SubprotocolMsgpackBrotli:
+		return newCompressingCodec(msgpackCodec{}, compressionThreshold)
+	default:
+		return jsonCodec{}
+	}
+}
+
+// jsonCodec is the default codec: JSON text frames, unchanged from this
+// service's original behavior.
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(v any) ([]byte, int, error) {
+	b, err := json.Marshal(v)
+	return b, websocket.TextMessage, err
+}
+
+func (jsonCodec) Decode(data []byte, _ int) (any, error) {
+	var v interface{}
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// msgpackCodec encodes as MessagePack binary frames - smaller than JSON for
+// the same payload, at the cost of not being human-readable on the wire.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(v any) ([]byte, int, error) {
+	b, err := msgpack.Marshal(v)
+	return b, websocket.BinaryMessage, err
+}
+
+func (msgpackCodec) Decode(data []byte, _ int) (any, error) {
+	var v interface{}
+	err := msgpack.Unmarshal(data, &v)
+	return v, err
+}
+
+// compressingCodec wraps another codec and brotli-compresses its encoded
+// output when at or above threshold bytes, falling back to gzip if brotli
+// compression fails (it shouldn't in practice, but a fallback is cheap
+// insurance against a payload brotli can't handle). Payloads below
+// threshold are passed through uncompressed, since compression overhead
+// isn't worth it for small frames (pings, acks, typing indicators).
+type compressingCodec struct {
+	inner     Codec
+	threshold int
+}
+
+func newCompressingCodec(inner Codec, threshold int) Codec {
+	return compressingCodec{inner: inner, threshold: threshold}
+}
+
+// compressionMarker prefixes a frame's payload to say which (if any)
+// compression was applied, since the frame itself carries no other way to
+// tell a compressed payload from a plain one.
+type compressionMarker byte
+
+const (
+	compressionNone compressionMarker = iota
+	compressionBrotli
+	compressionGzip
+)
+
+func (c compressingCodec) Encode(v any) ([]byte, int, error) {
+	b, messageType, err := c.inner.Encode(v)
+	if err != nil || len(b) < c.threshold {
+		return append([]byte{byte(compressionNone)}, b...), messageType, err
+	}
+
+	if compressed, err := brotliCompress(b); err == nil {
+		return append([]byte{byte(compressionBrotli)}, compressed...), websocket.BinaryMessage, nil
+	}
+
+	compressed, err := gzipCompress(b)
+	if err != nil {
+		// Compression failed entirely; send uncompressed rather than drop
+		// the message.
+		return append([]byte{byte(compressionNone)}, b...), messageType, nil
+	}
+	return append([]byte{byte(compressionGzip)}, compressed...), websocket.BinaryMessage, nil
+}
+
+func (c compressingCodec) Decode(data []byte, messageType int) (any, error) {
+	if len(data) == 0 {
+		return c.inner.Decode(data, messageType)
+	}
+
+	marker := compressionMarker(data[0])
+	payload := data[1:]
+
+	var err error
+	switch marker {
+	case compressionBrotli:
+		payload, err = brotliDecompress(payload)
+	case compressionGzip:
+		payload, err = gzipDecompress(payload)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c.inner.Decode(payload, messageType)
+}
+
+func brotliCompress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := brotli.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func brotliDecompress(b []byte) ([]byte, error) {
+	return io.ReadAll(brotli.NewReader(bytes.NewReader(b)))
+}
+
+func gzipCompress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gzipDecompress(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
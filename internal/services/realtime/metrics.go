@@ -0,0 +1,50 @@
+package realtime
+
+import (
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// wireStats tracks outbound WebSocket frame counts and byte totals, split
+// by message type (binary vs text) so operators can see how much the
+// msgpack/compressing codecs (see codec.go) actually save over plain JSON
+// without needing a packet capture.
+var wireStats struct {
+	textFrames   uint64
+	textBytes    uint64
+	binaryFrames uint64
+	binaryBytes  uint64
+}
+
+// recordWireFrame is called from Session.enqueue with the
+// already-encoded frame about to go on the wire.
+func recordWireFrame(messageType int, size int) {
+	if messageType == websocket.BinaryMessage {
+		atomic.AddUint64(&wireStats.binaryFrames, 1)
+		atomic.AddUint64(&wireStats.binaryBytes, uint64(size))
+		return
+	}
+	atomic.AddUint64(&wireStats.textFrames, 1)
+	atomic.AddUint64(&wireStats.textBytes, uint64(size))
+}
+
+// WireStats is a point-in-time snapshot of outbound frame counts and byte
+// totals for the /metrics endpoint.
+type WireStats struct {
+	TextFrames   uint64 `json:"text_frames"`
+	TextBytes    uint64 `json:"text_bytes"`
+	BinaryFrames uint64 `json:"binary_frames"`
+	BinaryBytes  uint64 `json:"binary_bytes"`
+}
+
+// SnapshotWireStats returns the totals recorded so far across every
+// connection's outbound frames.
+func SnapshotWireStats() WireStats {
+	return WireStats{
+		TextFrames:   atomic.LoadUint64(&wireStats.textFrames),
+		TextBytes:    atomic.LoadUint64(&wireStats.textBytes),
+		BinaryFrames: atomic.LoadUint64(&wireStats.binaryFrames),
+		BinaryBytes:  atomic.LoadUint64(&wireStats.binaryBytes),
+	}
+}
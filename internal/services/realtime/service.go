@@ -1,38 +1,418 @@
 package realtime
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
 	"log/slog"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"github.com/hastenr/chatapi/internal/metrics"
+)
+
+// sessionOutboundQueueSize bounds how many not-yet-written frames a
+// Session buffers before its queue counts as full; see
+// slowConsumerGrace for how long it's allowed to stay that way before the
+// session is evicted.
+const sessionOutboundQueueSize = 256
+
+// slowConsumerGrace is how long a Session's outbound queue may stay
+// continuously full before it's closed as a slow consumer, the pattern
+// used in the Spreed client refactor: a brief stall is normal and costs it
+// nothing, but a peer that never drains gets reaped instead of backing up
+// forever.
+const slowConsumerGrace = 5 * time.Second
+
+// bufferPool recycles the *bytes.Buffer each enqueued frame is copied
+// into, so fanning a broadcast out to many connections doesn't allocate a
+// fresh buffer per recipient.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// outboundFrame is a single already-encoded frame handed to a
+// Session's writer goroutine, with buf borrowed from bufferPool and
+// returned to it once written (or dropped).
+type outboundFrame struct {
+	messageType int
+	buf         *bytes.Buffer
+}
+
+// Flag is a bitmask of per-connection participation state, modeled on
+// Spreed's participant flags: a session advertises these via the "flags"
+// WebSocket message so other members of its joined rooms know, for
+// example, whether it's currently in a call before ringing it again.
+type Flag uint32
+
+const (
+	FlagDisconnected Flag = 1 << iota
+	FlagInCall
+	FlagWithAudio
+	FlagWithVideo
 )
 
+// Session owns one registered WebSocket connection end to end. A
+// dedicated writer goroutine drains out, so enqueueing a frame from a
+// broadcast path never blocks on that connection's underlying socket - a
+// stalled peer can only ever back up its own queue, never anyone else's.
+//
+// rooms and flags track this connection's own view of the bidirectional
+// protocol (join/leave/flags messages) - they're what BroadcastToJoined
+// and broadcastPresenceUpdate filter fan-out against, independent of the
+// DB-backed room_members check processBroadcast uses for persisted chat
+// messages, which must still reach a member's connections whether or not
+// it has explicitly joined.
+type Session struct {
+	conn     *websocket.Conn
+	codec    Codec
+	TenantID string
+	UserID   string
+
+	out chan outboundFrame
+
+	// stopCh signals writePump to drain out and exit; closed exactly once,
+	// by stop. out itself is never closed - every broadcast path releases
+	// s.mu before calling send, so a send can always be racing a disconnect
+	// or Shutdown, and closing a channel concurrent sends can land on
+	// panics.
+	stopCh   chan struct{}
+	stopOnce sync.Once
+
+	// writeMu guards gated/queued so a reconnect sync (see BeginSync) can
+	// hold live frames back until it has finished sending its own, without
+	// one slipping onto out in between.
+	writeMu sync.Mutex
+	gated   bool
+	queued  []outboundFrame
+
+	// fullSince is zero unless out is currently full; send evicts the
+	// session once it's stayed full for slowConsumerGrace.
+	fullMu    sync.Mutex
+	fullSince time.Time
+
+	evictOnce sync.Once
+
+	// roomsMu guards rooms, flags and lastDelivered, all set from the read
+	// loop and read from a concurrent broadcast fan-out.
+	roomsMu       sync.Mutex
+	rooms         map[string]struct{}
+	flags         Flag
+	lastDelivered map[string]int // roomID -> highest seq already sent, see MarkDelivered
+}
+
+// newSession starts conn's writer goroutine and registers it with
+// wg so Shutdown can wait for every session's in-flight writes to drain
+// before returning.
+func newSession(tenantID, userID string, conn *websocket.Conn, codec Codec, wg *sync.WaitGroup) *Session {
+	s := &Session{
+		conn:     conn,
+		codec:    codec,
+		TenantID: tenantID,
+		UserID:   userID,
+		out:      make(chan outboundFrame, sessionOutboundQueueSize),
+		stopCh:   make(chan struct{}),
+		rooms:    make(map[string]struct{}),
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.writePump()
+	}()
+
+	return s
+}
+
+// JoinRoom marks roomID as one this session wants live fan-out for (see
+// BroadcastToJoined and broadcastPresenceUpdate).
+func (s *Session) JoinRoom(roomID string) {
+	s.roomsMu.Lock()
+	s.rooms[roomID] = struct{}{}
+	s.roomsMu.Unlock()
+}
+
+// LeaveRoom undoes a prior JoinRoom; harmless if roomID was never joined.
+func (s *Session) LeaveRoom(roomID string) {
+	s.roomsMu.Lock()
+	delete(s.rooms, roomID)
+	s.roomsMu.Unlock()
+}
+
+// HasJoined reports whether this session has joined roomID.
+func (s *Session) HasJoined(roomID string) bool {
+	s.roomsMu.Lock()
+	_, ok := s.rooms[roomID]
+	s.roomsMu.Unlock()
+	return ok
+}
+
+// MarkDelivered records that messageSeq is the highest seq this session has
+// been sent for roomID, so a live broadcast racing in for a seq already
+// covered by a resume replay (see ws.Handler.replayMissed) can be
+// recognized by ShouldSuppress instead of delivered a second time.
+func (s *Session) MarkDelivered(roomID string, messageSeq int) {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	if s.lastDelivered == nil {
+		s.lastDelivered = make(map[string]int)
+	}
+	if messageSeq > s.lastDelivered[roomID] {
+		s.lastDelivered[roomID] = messageSeq
+	}
+}
+
+// ShouldSuppress reports whether messageSeq for roomID has already been
+// delivered to this session (see MarkDelivered) and so should be dropped
+// from a live broadcast rather than delivered again.
+func (s *Session) ShouldSuppress(roomID string, messageSeq int) bool {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	return messageSeq <= s.lastDelivered[roomID]
+}
+
+// JoinedRooms returns the room IDs this session currently has joined.
+func (s *Session) JoinedRooms() []string {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+
+	rooms := make([]string, 0, len(s.rooms))
+	for roomID := range s.rooms {
+		rooms = append(rooms, roomID)
+	}
+	return rooms
+}
+
+// SetFlags replaces this session's advertised participation flags.
+func (s *Session) SetFlags(flags Flag) {
+	s.roomsMu.Lock()
+	s.flags = flags
+	s.roomsMu.Unlock()
+}
+
+// Flags returns this session's currently advertised participation flags.
+func (s *Session) Flags() Flag {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	return s.flags
+}
+
+// SendMessage encodes message with this session's negotiated codec and
+// enqueues it for delivery, the targeted-push counterpart to
+// Service.SendToUser for callers that already hold a specific Session
+// (e.g. a join/leave/flags handler acting on the connection it arrived on).
+func (s *Session) SendMessage(message interface{}) error {
+	data, messageType, err := s.codec.Encode(message)
+	if err != nil {
+		return err
+	}
+	s.enqueue(messageType, data, messageTypeLabel(message))
+	return nil
+}
+
+// stop signals writePump to drain whatever's already queued in out and
+// exit, without closing out - see out's doc comment for why out itself
+// can't be closed here. Safe to call more than once.
+func (s *Session) stop() {
+	s.stopOnce.Do(func() { close(s.stopCh) })
+}
+
+// writeFrame writes frame to conn and returns its buf to bufferPool.
+func (s *Session) writeFrame(frame outboundFrame) error {
+	err := s.conn.WriteMessage(frame.messageType, frame.buf.Bytes())
+	frame.buf.Reset()
+	bufferPool.Put(frame.buf)
+	return err
+}
+
+// writePump drains out until stop is called (by UnregisterConnection or
+// Shutdown) or a write fails, then closes conn either way - a closed conn
+// unblocks the handler's read loop, which runs UnregisterConnection as part
+// of its own cleanup. Once stopped, it keeps draining whatever's already
+// buffered in out before exiting, so a frame enqueued just before stop
+// (e.g. Shutdown's "server.shutdown" notice) still reaches the client.
+func (s *Session) writePump() {
+	defer s.conn.Close()
+	for {
+		select {
+		case frame := <-s.out:
+			if err := s.writeFrame(frame); err != nil {
+				slog.Warn("WebSocket write failed, closing connection", "error", err)
+				return
+			}
+		case <-s.stopCh:
+			for {
+				select {
+				case frame := <-s.out:
+					if err := s.writeFrame(frame); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// enqueue copies data into a pooled buffer and hands it to send, the path
+// every broadcast site uses instead of writing the socket inline. label is
+// the original message's logical "type" field (see messageTypeLabel), kept
+// separate from messageType (the wire-level text/binary constant) so
+// chatapi_ws_messages_sent_total can break delivered volume down by what
+// was actually sent, not just how it was framed.
+func (s *Session) enqueue(messageType int, data []byte, label string) {
+	recordWireFrame(messageType, len(data))
+	metrics.WSMessagesSent.WithLabelValues(s.TenantID, label).Inc()
+
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	buf.Write(data)
+	s.send(outboundFrame{messageType: messageType, buf: buf})
+}
+
+// messageTypeLabel extracts the "type" field from message for the
+// chatapi_ws_messages_sent_total metric. Every payload sent to a session is
+// a map[string]interface{}{"type": ..., ...} (see this package's and
+// ws.Handler's message construction); anything else is labeled "unknown"
+// rather than guessed at.
+func messageTypeLabel(message interface{}) string {
+	if m, ok := message.(map[string]interface{}); ok {
+		if t, ok := m["type"].(string); ok {
+			return t
+		}
+	}
+	return "unknown"
+}
+
+// send hands frame to the writer goroutine, or - while gated - appends it
+// to queued for EndSync to flush in order. A momentarily full queue isn't
+// fatal; only slowConsumerGrace of continuously full queue gets the
+// session evicted, so one slow moment doesn't cost it the connection.
+func (s *Session) send(frame outboundFrame) {
+	s.writeMu.Lock()
+	if s.gated {
+		s.queued = append(s.queued, frame)
+		s.writeMu.Unlock()
+		return
+	}
+	s.writeMu.Unlock()
+
+	select {
+	case s.out <- frame:
+		s.fullMu.Lock()
+		s.fullSince = time.Time{}
+		s.fullMu.Unlock()
+	default:
+		bufferPool.Put(frame.buf)
+
+		s.fullMu.Lock()
+		if s.fullSince.IsZero() {
+			s.fullSince = time.Now()
+		}
+		full := time.Since(s.fullSince)
+		s.fullMu.Unlock()
+
+		slog.Warn("WebSocket outbound queue full, dropping frame", "queue_size", sessionOutboundQueueSize)
+		if full >= slowConsumerGrace {
+			s.evictSlowConsumer()
+		}
+	}
+}
+
+// evictSlowConsumer closes the connection with a policy-violation close
+// frame naming the reason, instead of leaving a stalled peer's backlog to
+// grow forever. Safe to call more than once; only the first call acts.
+func (s *Session) evictSlowConsumer() {
+	s.evictOnce.Do(func() {
+		slog.Warn("Evicting slow WebSocket consumer", "queue_size", sessionOutboundQueueSize, "grace", slowConsumerGrace)
+		reason := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "slow_consumer")
+		_ = s.conn.WriteControl(websocket.CloseMessage, reason, time.Now().Add(time.Second))
+		s.conn.Close()
+	})
+}
+
+// beginGate starts buffering writes to this connection instead of
+// enqueueing them.
+func (s *Session) beginGate() {
+	s.writeMu.Lock()
+	s.gated = true
+	s.writeMu.Unlock()
+}
+
+// endGate stops buffering and sends whatever queued up, in order.
+func (s *Session) endGate() {
+	s.writeMu.Lock()
+	queued := s.queued
+	s.queued = nil
+	s.gated = false
+	s.writeMu.Unlock()
+
+	for _, f := range queued {
+		s.send(f)
+	}
+}
+
+// encodedFrame caches one codec's encoding of a broadcast message, so
+// fanning it out to every session sharing that negotiated codec marshals
+// it once instead of once per recipient.
+type encodedFrame struct {
+	data        []byte
+	messageType int
+}
+
+// encodeFor returns codec's encoding of message, computed once per codec
+// and reused from cache for every other session sharing it within the
+// same broadcast fan-out.
+func encodeFor(cache map[Codec]encodedFrame, codec Codec, message interface{}) (encodedFrame, error) {
+	if f, ok := cache[codec]; ok {
+		return f, nil
+	}
+	data, messageType, err := codec.Encode(message)
+	if err != nil {
+		return encodedFrame{}, err
+	}
+	f := encodedFrame{data: data, messageType: messageType}
+	cache[codec] = f
+	return f, nil
+}
+
 // Service manages WebSocket connections and real-time messaging
 type Service struct {
 	mu           sync.RWMutex
 	db           *sql.DB
-	connections  map[string]map[string][]*websocket.Conn // tenant -> user -> connections
-	presence     map[string]map[string]time.Time         // tenant -> user -> last seen
+	connections  map[string]map[string][]*Session // tenant -> user -> sessions
+	presence     map[string]map[string]time.Time  // tenant -> user -> last seen
 	broadcastCh  chan *broadcastMessage
 	shutdownCh   chan struct{}
 	shutdownOnce sync.Once
+	backplane    *Backplane
+
+	// messagesDone tracks every Session's writer goroutine, so
+	// Shutdown can wait for in-flight writes to drain instead of tearing
+	// down mid-write.
+	messagesDone sync.WaitGroup
 }
 
 type broadcastMessage struct {
 	tenantID string
 	roomID   string
 	message  interface{}
+
+	// seq is the persisted message's sequence number, or 0 for a
+	// broadcastMessage that isn't a sequenced chat message (acks, typing,
+	// presence). processBroadcast uses it to skip a session that already
+	// received this seq via a resume replay (see Session.MarkDelivered).
+	seq int
 }
 
 // NewService creates a new realtime service
 func NewService(db *sql.DB) *Service {
 	s := &Service{
 		db:          db,
-		connections: make(map[string]map[string][]*websocket.Conn),
+		connections: make(map[string]map[string][]*Session),
 		presence:    make(map[string]map[string]time.Time),
 		broadcastCh: make(chan *broadcastMessage, 1000), // buffered channel
 		shutdownCh:  make(chan struct{}),
@@ -47,18 +427,24 @@ func NewService(db *sql.DB) *Service {
 	return s
 }
 
-// RegisterConnection registers a new WebSocket connection for a user
-func (s *Service) RegisterConnection(tenantID, userID string, conn *websocket.Conn) {
+// RegisterConnection registers a new WebSocket connection for a user, using
+// codec to encode/decode everything sent or received on it. Pass jsonCodec{}
+// (the zero value behavior before per-connection codecs existed) for a
+// connection that didn't negotiate a subprotocol. The returned Session is
+// the handle a caller needs to act on join/leave/flags messages arriving
+// on this specific connection.
+func (s *Service) RegisterConnection(tenantID, userID string, conn *websocket.Conn, codec Codec) *Session {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// Initialize tenant map if needed
 	if s.connections[tenantID] == nil {
-		s.connections[tenantID] = make(map[string][]*websocket.Conn)
+		s.connections[tenantID] = make(map[string][]*Session)
 	}
 
 	// Add connection
-	s.connections[tenantID][userID] = append(s.connections[tenantID][userID], conn)
+	session := newSession(tenantID, userID, conn, codec, &s.messagesDone)
+	s.connections[tenantID][userID] = append(s.connections[tenantID][userID], session)
 
 	// Update presence
 	if s.presence[tenantID] == nil {
@@ -66,10 +452,14 @@ func (s *Service) RegisterConnection(tenantID, userID string, conn *websocket.Co
 	}
 	s.presence[tenantID][userID] = time.Now()
 
+	metrics.WSConnections.WithLabelValues(tenantID).Inc()
+
 	slog.Info("WebSocket connection registered",
 		"tenant_id", tenantID,
 		"user_id", userID,
 		"total_connections", len(s.connections[tenantID][userID]))
+
+	return session
 }
 
 // UnregisterConnection removes a WebSocket connection for a user
@@ -83,10 +473,12 @@ func (s *Service) UnregisterConnection(tenantID, userID string, conn *websocket.
 	}
 
 	// Remove the specific connection
-	for i, c := range connections {
-		if c == conn {
+	for i, session := range connections {
+		if session.conn == conn {
 			// Remove connection from slice
 			s.connections[tenantID][userID] = append(connections[:i], connections[i+1:]...)
+			session.stop() // stops its writer goroutine, which then closes conn
+			metrics.WSConnections.WithLabelValues(tenantID).Dec()
 			break
 		}
 	}
@@ -113,22 +505,90 @@ func (s *Service) UnregisterConnection(tenantID, userID string, conn *websocket.
 		"remaining_connections", len(s.connections[tenantID][userID]))
 }
 
+// SetBackplane wires bp into the service so BroadcastMessage also announces
+// committed messages to other nodes. Must be called before any call to
+// BroadcastMessage; nil is a valid (single-node, no-op) backplane.
+func (s *Service) SetBackplane(bp *Backplane) {
+	s.backplane = bp
+}
+
+// BroadcastMessage broadcasts a committed chat message to this node's local
+// room members and, if a Backplane is configured, publishes it on the
+// room's broker subject so sibling nodes can deliver it to their own local
+// connections among the room's members.
+func (s *Service) BroadcastMessage(tenantID, roomID, messageID string, seq int64, payload interface{}) {
+	s.broadcastSequenced(tenantID, roomID, int(seq), payload)
+
+	if s.backplane == nil {
+		return
+	}
+	members, err := s.getRoomMembers(tenantID, roomID)
+	if err != nil {
+		slog.Error("Failed to resolve room members for backplane fanout",
+			"tenant_id", tenantID, "room_id", roomID, "error", err)
+		return
+	}
+	if err := s.backplane.PublishMessageEvent(MessageEvent{
+		TenantID:      tenantID,
+		RoomID:        roomID,
+		MessageID:     messageID,
+		Seq:           seq,
+		TargetUserIDs: members,
+	}); err != nil {
+		slog.Error("Failed to publish message event to backplane",
+			"tenant_id", tenantID, "room_id", roomID, "error", err)
+	}
+}
+
+// BroadcastAck broadcasts a recorded delivery ack to this node's local room
+// members and, like BroadcastMessage, publishes it for sibling nodes when a
+// Backplane is configured.
+func (s *Service) BroadcastAck(tenantID, roomID, userID string, seq int, payload interface{}) {
+	s.BroadcastToRoom(tenantID, roomID, payload)
+
+	if s.backplane == nil {
+		return
+	}
+	if err := s.backplane.PublishAckEvent(AckEvent{
+		TenantID: tenantID,
+		RoomID:   roomID,
+		UserID:   userID,
+		Seq:      seq,
+	}); err != nil {
+		slog.Error("Failed to publish ack event to backplane",
+			"tenant_id", tenantID, "room_id", roomID, "error", err)
+	}
+}
+
 // BroadcastToRoom broadcasts a message to all users in a room
 func (s *Service) BroadcastToRoom(tenantID, roomID string, message interface{}) {
+	s.broadcastSequenced(tenantID, roomID, 0, message)
+}
+
+// broadcastSequenced is BroadcastToRoom's implementation, additionally
+// tagging the broadcastMessage with seq (0 for anything that isn't a
+// persisted chat message) so processBroadcast can dedupe against a
+// session's resume replay.
+func (s *Service) broadcastSequenced(tenantID, roomID string, seq int, message interface{}) {
 	select {
 	case s.broadcastCh <- &broadcastMessage{
 		tenantID: tenantID,
 		roomID:   roomID,
 		message:  message,
+		seq:      seq,
 	}:
+		metrics.BroadcastQueueDepth.Set(float64(len(s.broadcastCh)))
 	default:
+		metrics.BroadcastDropped.Inc()
 		slog.Warn("Broadcast channel full, dropping message",
 			"tenant_id", tenantID,
 			"room_id", roomID)
 	}
 }
 
-// SendToUser sends a message directly to a specific user
+// SendToUser sends a message directly to a specific user, encoding it once
+// per negotiated codec and enqueueing it on each of the user's connections'
+// writer goroutines.
 func (s *Service) SendToUser(tenantID, userID string, message interface{}) {
 	s.mu.RLock()
 	connections, exists := s.connections[tenantID][userID]
@@ -141,23 +601,45 @@ func (s *Service) SendToUser(tenantID, userID string, message interface{}) {
 		return
 	}
 
-	messageBytes, err := json.Marshal(message)
-	if err != nil {
-		slog.Error("Failed to marshal message for user",
-			"tenant_id", tenantID,
-			"user_id", userID,
-			"error", err)
-		return
-	}
-
-	for _, conn := range connections {
-		if err := conn.WriteMessage(websocket.TextMessage, messageBytes); err != nil {
-			slog.Warn("Failed to send message to user connection",
+	label := messageTypeLabel(message)
+	cache := make(map[Codec]encodedFrame)
+	for _, session := range connections {
+		frame, err := encodeFor(cache, session.codec, message)
+		if err != nil {
+			slog.Error("Failed to encode message for user",
 				"tenant_id", tenantID,
 				"user_id", userID,
 				"error", err)
-			// Connection might be dead, but we'll let the connection handler deal with it
+			continue
 		}
+		session.enqueue(frame.messageType, frame.data, label)
+	}
+}
+
+// BeginSync pauses live delivery to every one of userID's current
+// connections: SendToUser, BroadcastToRoom, and presence updates queue
+// instead of being enqueued until EndSync is called. Use this around a
+// reconnect sync so its own replayed frames can't land interleaved with a
+// live broadcast racing in on another goroutine.
+func (s *Service) BeginSync(tenantID, userID string) {
+	s.mu.RLock()
+	connections := s.connections[tenantID][userID]
+	s.mu.RUnlock()
+
+	for _, session := range connections {
+		session.beginGate()
+	}
+}
+
+// EndSync resumes live delivery to userID's connections and sends
+// whatever queued up while gated, in the order it arrived.
+func (s *Service) EndSync(tenantID, userID string) {
+	s.mu.RLock()
+	connections := s.connections[tenantID][userID]
+	s.mu.RUnlock()
+
+	for _, session := range connections {
+		session.endGate()
 	}
 }
 
@@ -187,12 +669,67 @@ func (s *Service) GetOnlineUsers(tenantID string) []string {
 	return onlineUsers
 }
 
-// BroadcastPresenceUpdate broadcasts presence changes
+// ConnectionCountsByTenant returns the number of currently registered
+// WebSocket connections for each tenant that has at least one, for the
+// GET /health?verbose=1 diagnostic.
+func (s *Service) ConnectionCountsByTenant() map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string]int, len(s.connections))
+	for tenantID, users := range s.connections {
+		var n int
+		for _, sessions := range users {
+			n += len(sessions)
+		}
+		if n > 0 {
+			counts[tenantID] = n
+		}
+	}
+	return counts
+}
+
+// BroadcastQueueSaturation returns the broadcast channel's current depth and
+// capacity, so GET /health?verbose=1 can surface the "channel full,
+// dropping" condition (see broadcastSequenced) before it starts happening.
+func (s *Service) BroadcastQueueSaturation() (depth, capacity int) {
+	return len(s.broadcastCh), cap(s.broadcastCh)
+}
+
+// BrokerHealthy reports whether this node's Backplane (if any) can still
+// publish to its broker. A service with no Backplane configured is
+// single-node and has no broker connection to lose, so it reports healthy.
+func (s *Service) BrokerHealthy() bool {
+	if s.backplane == nil {
+		return true
+	}
+	return s.backplane.Healthy()
+}
+
+// BroadcastPresenceUpdate broadcasts presence changes to this node's local
+// connections and, if a Backplane is configured, to sibling nodes' local
+// connections for the same tenant.
 func (s *Service) BroadcastPresenceUpdate(tenantID, userID, status string) {
 	s.broadcastPresenceUpdate(tenantID, userID, status)
+
+	if s.backplane == nil {
+		return
+	}
+	if err := s.backplane.PublishPresenceEvent(PresenceEvent{
+		TenantID: tenantID,
+		UserID:   userID,
+		Status:   status,
+	}); err != nil {
+		slog.Error("Failed to publish presence event to backplane",
+			"tenant_id", tenantID, "user_id", userID, "error", err)
+	}
 }
 
-// broadcastPresenceUpdate sends presence updates to relevant users
+// broadcastPresenceUpdate delivers a presence change only to sessions that
+// share a joined room with userID, rather than every connection in the
+// tenant: it resolves the rooms userID belongs to, then for each such
+// room fans out to that room's other members' sessions that have
+// themselves joined it (see Session.JoinRoom).
 func (s *Service) broadcastPresenceUpdate(tenantID, userID, status string) {
 	presenceMsg := map[string]interface{}{
 		"type":      "presence.update",
@@ -201,24 +738,73 @@ func (s *Service) broadcastPresenceUpdate(tenantID, userID, status string) {
 		"timestamp": time.Now().Unix(),
 	}
 
-	// For now, broadcast to all connected users in the tenant
-	// In a more sophisticated implementation, you might track which users
-	// are subscribed to which presence updates
+	rooms, err := s.getUserRooms(tenantID, userID)
+	if err != nil {
+		slog.Error("Failed to resolve rooms for presence update", "tenant_id", tenantID, "user_id", userID, "error", err)
+		return
+	}
+
 	s.mu.RLock()
 	tenantConnections := s.connections[tenantID]
 	s.mu.RUnlock()
 
-	messageBytes, err := json.Marshal(presenceMsg)
+	cache := make(map[Codec]encodedFrame)
+	delivered := make(map[*Session]struct{})
+	for _, roomID := range rooms {
+		members, err := s.getRoomMembers(tenantID, roomID)
+		if err != nil {
+			slog.Error("Failed to get room members for presence update", "tenant_id", tenantID, "room_id", roomID, "error", err)
+			continue
+		}
+		for _, memberID := range members {
+			if memberID == userID {
+				continue
+			}
+			for _, session := range tenantConnections[memberID] {
+				if _, done := delivered[session]; done || !session.HasJoined(roomID) {
+					continue
+				}
+				frame, err := encodeFor(cache, session.codec, presenceMsg)
+				if err != nil {
+					slog.Error("Failed to encode presence message", "error", err)
+					continue
+				}
+				session.enqueue(frame.messageType, frame.data, "presence.update")
+				delivered[session] = struct{}{}
+			}
+		}
+	}
+}
+
+// BroadcastToJoined delivers message to every connected session in
+// tenantID/roomID that has explicitly joined the room (see
+// Session.JoinRoom), the fan-out used for ephemeral per-room signaling
+// like typing indicators and call-state flags that shouldn't reach a
+// member's connection before it's actually looking at the room.
+func (s *Service) BroadcastToJoined(tenantID, roomID string, message interface{}) {
+	members, err := s.getRoomMembers(tenantID, roomID)
 	if err != nil {
-		slog.Error("Failed to marshal presence message", "error", err)
+		slog.Error("Failed to get room members for joined broadcast", "tenant_id", tenantID, "room_id", roomID, "error", err)
 		return
 	}
 
-	for _, connections := range tenantConnections {
-		for _, conn := range connections {
-			if err := conn.WriteMessage(websocket.TextMessage, messageBytes); err != nil {
-				slog.Warn("Failed to send presence update", "error", err)
+	s.mu.RLock()
+	tenantConnections := s.connections[tenantID]
+	s.mu.RUnlock()
+
+	label := messageTypeLabel(message)
+	cache := make(map[Codec]encodedFrame)
+	for _, memberID := range members {
+		for _, session := range tenantConnections[memberID] {
+			if !session.HasJoined(roomID) {
+				continue
+			}
+			frame, err := encodeFor(cache, session.codec, message)
+			if err != nil {
+				slog.Error("Failed to encode joined-room broadcast", "tenant_id", tenantID, "room_id", roomID, "error", err)
+				continue
 			}
+			session.enqueue(frame.messageType, frame.data, label)
 		}
 	}
 }
@@ -228,6 +814,7 @@ func (s *Service) broadcastWorker() {
 	for {
 		select {
 		case msg := <-s.broadcastCh:
+			metrics.BroadcastQueueDepth.Set(float64(len(s.broadcastCh)))
 			s.processBroadcast(msg)
 		case <-s.shutdownCh:
 			return
@@ -247,29 +834,33 @@ func (s *Service) processBroadcast(msg *broadcastMessage) {
 		return
 	}
 
-	messageBytes, err := json.Marshal(msg.message)
-	if err != nil {
-		slog.Error("Failed to marshal broadcast message",
-			"tenant_id", msg.tenantID,
-			"room_id", msg.roomID,
-			"error", err)
-		return
-	}
-
 	s.mu.RLock()
 	tenantConnections := s.connections[msg.tenantID]
 	s.mu.RUnlock()
 
+	label := messageTypeLabel(msg.message)
+	cache := make(map[Codec]encodedFrame)
+
 	// Only broadcast to room members who are connected
 	for _, memberID := range roomMembers {
 		if connections, exists := tenantConnections[memberID]; exists {
-			for _, conn := range connections {
-				if err := conn.WriteMessage(websocket.TextMessage, messageBytes); err != nil {
-					slog.Warn("Failed to broadcast message to user",
+			for _, session := range connections {
+				if msg.seq > 0 && session.ShouldSuppress(msg.roomID, msg.seq) {
+					// Already sent to this session by a resume replay that
+					// raced with this live broadcast; see Session.MarkDelivered.
+					continue
+				}
+				frame, err := encodeFor(cache, session.codec, msg.message)
+				if err != nil {
+					slog.Error("Failed to encode broadcast message",
 						"tenant_id", msg.tenantID,
-						"user_id", memberID,
 						"room_id", msg.roomID,
 						"error", err)
+					continue
+				}
+				session.enqueue(frame.messageType, frame.data, label)
+				if msg.seq > 0 {
+					session.MarkDelivered(msg.roomID, msg.seq)
 				}
 			}
 		}
@@ -278,30 +869,65 @@ func (s *Service) processBroadcast(msg *broadcastMessage) {
 
 // getRoomMembers retrieves the list of user IDs who are members of a room
 func (s *Service) getRoomMembers(tenantID, roomID string) ([]string, error) {
-	query := `
-		SELECT user_id
-		FROM room_members
-		WHERE tenant_id = ? AND chatroom_id = ?
-	`
+	var members []string
+	err := metrics.ObserveDBQuery("get_room_members", func() error {
+		rows, err := s.db.Query(`
+			SELECT user_id
+			FROM room_members
+			WHERE tenant_id = ? AND chatroom_id = ?
+		`, tenantID, roomID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
 
-	rows, err := s.db.Query(query, tenantID, roomID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+		for rows.Next() {
+			var userID string
+			if err := rows.Scan(&userID); err != nil {
+				return err
+			}
+			members = append(members, userID)
+		}
+		return rows.Err()
+	})
+	return members, err
+}
 
-	var members []string
-	for rows.Next() {
-		var userID string
-		if err := rows.Scan(&userID); err != nil {
-			return nil, err
+// getUserRooms retrieves the list of room IDs userID is a member of,
+// the inverse of getRoomMembers, used to scope a presence update to
+// rooms it's actually shared in rather than the whole tenant.
+func (s *Service) getUserRooms(tenantID, userID string) ([]string, error) {
+	var rooms []string
+	err := metrics.ObserveDBQuery("get_user_rooms", func() error {
+		rows, err := s.db.Query(`
+			SELECT chatroom_id
+			FROM room_members
+			WHERE tenant_id = ? AND user_id = ?
+		`, tenantID, userID)
+		if err != nil {
+			return err
 		}
-		members = append(members, userID)
-	}
+		defer rows.Close()
 
-	return members, rows.Err()
+		for rows.Next() {
+			var roomID string
+			if err := rows.Scan(&roomID); err != nil {
+				return err
+			}
+			rooms = append(rooms, roomID)
+		}
+		return rows.Err()
+	})
+	return rooms, err
 }
 
+// presenceCleanupWorker periodically sweeps stale presence entries so users
+// who disconnected without a clean close (crash, network drop) don't stay
+// "online" forever.
+func (s *Service) presenceCleanupWorker() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-ticker.C:
@@ -332,28 +958,30 @@ func (s *Service) cleanupStalePresence() {
 	}
 }
 
-// Shutdown gracefully shuts down the realtime service
+// Shutdown gracefully shuts down the realtime service: every connection is
+// sent a shutdown notice and its writer goroutine stopped, then Shutdown
+// waits (bounded by ctx) for those goroutines to drain their in-flight
+// writes before returning, instead of tearing the process down mid-write.
 func (s *Service) Shutdown(ctx context.Context) error {
 	s.shutdownOnce.Do(func() {
 		close(s.shutdownCh)
 	})
 
-	// Close all connections
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
 	shutdownMsg := map[string]interface{}{
-		"type":             "server.shutdown",
+		"type":               "server.shutdown",
 		"reconnect_after_ms": 5000,
 	}
 
-	messageBytes, _ := json.Marshal(shutdownMsg)
-
 	for tenantID, tenantConnections := range s.connections {
 		for userID, connections := range tenantConnections {
-			for _, conn := range connections {
-				conn.WriteMessage(websocket.TextMessage, messageBytes)
-				conn.Close()
+			for _, session := range connections {
+				if messageBytes, messageType, err := session.codec.Encode(shutdownMsg); err == nil {
+					session.enqueue(messageType, messageBytes, "server.shutdown")
+				}
+				session.stop()
+				metrics.WSConnections.WithLabelValues(tenantID).Dec()
 			}
 			slog.Info("Closed connections for user",
 				"tenant_id", tenantID,
@@ -363,8 +991,21 @@ func (s *Service) Shutdown(ctx context.Context) error {
 	}
 
 	// Clear connection maps
-	s.connections = make(map[string]map[string][]*websocket.Conn)
+	s.connections = make(map[string]map[string][]*Session)
 	s.presence = make(map[string]map[string]time.Time)
 
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.messagesDone.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+	}
+
 	return nil
-}
\ No newline at end of file
+}
@@ -7,17 +7,29 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
-	"sync"
+	"net/netip"
+	"time"
 
+	"github.com/hastenr/chatapi/internal/config"
 	"github.com/hastenr/chatapi/internal/models"
 	"github.com/hastenr/chatapi/internal/ratelimit"
 )
 
+// Route keys passed to CheckRateLimit - these must match the patterns the
+// routes are registered with in transport.NewServer, since that's what ends
+// up in http.Request.Pattern at dispatch time.
+const (
+	RouteMessages = "POST /rooms/{room_id}/messages"
+	RouteNotify   = "POST /notify"
+	RouteWS       = "GET /ws"
+)
+
 // Service handles tenant operations
 type Service struct {
-	db            *sql.DB
-	rateLimiters  sync.Map // map[string]*ratelimit.TokenBucket
+	db               *sql.DB
+	limiter          *ratelimit.Limiter
 	defaultRateLimit int
+	ipLimit          ratelimit.RouteLimit
 }
 
 // TenantConfig represents per-tenant configuration
@@ -26,16 +38,64 @@ type TenantConfig struct {
 	RetryLimit     int `json:"retry_limit"`
 	DurableNotifications bool `json:"durable_notifications"`
 	RateLimit      int `json:"rate_limit"` // requests per second
+	// BinaryProtocol allows this tenant's WebSocket clients to negotiate a
+	// msgpack subprotocol (see realtime.SupportedSubprotocols); false
+	// restricts them to the JSON subprotocol regardless of what the client
+	// offers.
+	BinaryProtocol bool `json:"binary_protocol"`
+	// WebhookURL, if set, is where webhook.Service.DispatchEvent delivers
+	// this tenant's room/message/presence event webhooks. WebhookSecret
+	// signs each delivery; DispatchEvent is a no-op while WebhookURL is
+	// empty.
+	WebhookURL    string `json:"webhook_url,omitempty"`
+	WebhookSecret string `json:"webhook_secret,omitempty"`
 }
 
-// NewService creates a new tenant service
-func NewService(db *sql.DB) *Service {
+// NewService creates a new tenant service. cfg supplies the per-route,
+// per-tenant, and process-wide bucket capacities/refill rates for the
+// layered rate limiter; see ReloadRateLimits to apply a changed cfg without
+// restarting.
+func NewService(db *sql.DB, cfg *config.Config) *Service {
 	return &Service{
 		db:               db,
-		defaultRateLimit: 100, // requests per second
+		limiter:          ratelimit.NewLimiter(routeLimitsFromConfig(cfg), defaultRouteLimit(cfg), tenantRouteLimit(cfg), globalRouteLimit(cfg)),
+		defaultRateLimit: cfg.DefaultRateLimit,
+		ipLimit:          ipRouteLimit(cfg),
+	}
+}
+
+// ReloadRateLimits re-reads cfg's rate limit fields and applies them to the
+// running limiter without restarting the service or losing in-flight bucket
+// state.
+func (s *Service) ReloadRateLimits(cfg *config.Config) {
+	s.limiter.UpdateLimits(routeLimitsFromConfig(cfg), defaultRouteLimit(cfg), tenantRouteLimit(cfg), globalRouteLimit(cfg))
+	s.ipLimit = ipRouteLimit(cfg)
+}
+
+func routeLimitsFromConfig(cfg *config.Config) map[string]ratelimit.RouteLimit {
+	return map[string]ratelimit.RouteLimit{
+		RouteMessages: {Capacity: cfg.RateLimitMessagesCapacity, RefillRate: cfg.RateLimitMessagesRefill},
+		RouteNotify:   {Capacity: cfg.RateLimitNotifyCapacity, RefillRate: cfg.RateLimitNotifyRefill},
+		RouteWS:       {Capacity: cfg.RateLimitWSCapacity, RefillRate: cfg.RateLimitWSRefill},
 	}
 }
 
+func defaultRouteLimit(cfg *config.Config) ratelimit.RouteLimit {
+	return ratelimit.RouteLimit{Capacity: cfg.RateLimitDefaultCapacity, RefillRate: cfg.RateLimitDefaultRefill}
+}
+
+func tenantRouteLimit(cfg *config.Config) ratelimit.RouteLimit {
+	return ratelimit.RouteLimit{Capacity: cfg.RateLimitTenantCapacity, RefillRate: cfg.RateLimitTenantRefill}
+}
+
+func globalRouteLimit(cfg *config.Config) ratelimit.RouteLimit {
+	return ratelimit.RouteLimit{Capacity: cfg.RateLimitGlobalCapacity, RefillRate: cfg.RateLimitGlobalRefill}
+}
+
+func ipRouteLimit(cfg *config.Config) ratelimit.RouteLimit {
+	return ratelimit.RouteLimit{Capacity: cfg.RateLimitIPCapacity, RefillRate: cfg.RateLimitIPRefill}
+}
+
 // ValidateAPIKey validates an API key and returns the tenant
 func (s *Service) ValidateAPIKey(apiKey string) (*models.Tenant, error) {
 	var tenant models.Tenant
@@ -64,6 +124,34 @@ func (s *Service) ValidateAPIKey(apiKey string) (*models.Tenant, error) {
 	return &tenant, nil
 }
 
+// GetTenantByID retrieves a tenant by its ID
+func (s *Service) GetTenantByID(tenantID string) (*models.Tenant, error) {
+	var tenant models.Tenant
+	query := `
+		SELECT tenant_id, api_key, name, config, created_at
+		FROM tenants
+		WHERE tenant_id = ?
+	`
+
+	err := s.db.QueryRow(query, tenantID).Scan(
+		&tenant.TenantID,
+		&tenant.APIKey,
+		&tenant.Name,
+		&tenant.Config,
+		&tenant.CreatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("tenant not found")
+	}
+	if err != nil {
+		slog.Error("Failed to get tenant", "error", err)
+		return nil, fmt.Errorf("database error")
+	}
+
+	return &tenant, nil
+}
+
 // CreateTenant creates a new tenant with a generated API key
 func (s *Service) CreateTenant(name string) (*models.Tenant, error) {
 	// Generate tenant ID (UUID)
@@ -78,6 +166,7 @@ func (s *Service) CreateTenant(name string) (*models.Tenant, error) {
 		RetryLimit:           5,
 		DurableNotifications: true,
 		RateLimit:            s.defaultRateLimit,
+		BinaryProtocol:       true,
 	}
 	configJSON, err := json.Marshal(config)
 	if err != nil {
@@ -140,6 +229,7 @@ func (s *Service) GetTenantConfig(tenantID string) (*TenantConfig, error) {
 		RetryLimit:          5,
 		DurableNotifications: true,
 		RateLimit:           s.defaultRateLimit,
+		BinaryProtocol:      true,
 	}
 
 	if configJSON != "" {
@@ -151,32 +241,72 @@ func (s *Service) GetTenantConfig(tenantID string) (*TenantConfig, error) {
 	return config, nil
 }
 
-// CheckRateLimit checks if a tenant is within their rate limit
-func (s *Service) CheckRateLimit(tenantID string) error {
-	// Get or create rate limiter for this tenant
-	rateLimiter, exists := s.rateLimiters.Load(tenantID)
-	if !exists {
-		config, err := s.GetTenantConfig(tenantID)
-		var bucket *ratelimit.TokenBucket
-		if err != nil {
-			slog.Warn("Failed to get tenant config for rate limiting, using default", "tenant_id", tenantID, "error", err)
-			bucket = ratelimit.NewTokenBucket(float64(s.defaultRateLimit), float64(s.defaultRateLimit)/2.0)
-		} else {
-			bucket = ratelimit.NewTokenBucket(float64(config.RateLimit), float64(config.RateLimit)/2.0)
-		}
-		s.rateLimiters.Store(tenantID, bucket)
-		rateLimiter = bucket
+// SetWebhookConfig sets tenantID's event webhook URL and signing secret,
+// generating a secret if none is supplied. Pass an empty url to disable
+// event webhook dispatch for the tenant.
+func (s *Service) SetWebhookConfig(tenantID, webhookURL, secret string) error {
+	cfg, err := s.GetTenantConfig(tenantID)
+	if err != nil {
+		return err
 	}
 
-	bucket := rateLimiter.(*ratelimit.TokenBucket)
+	cfg.WebhookURL = webhookURL
+	if webhookURL != "" && secret == "" && cfg.WebhookSecret == "" {
+		secret = generateRandomHex(32)
+	}
+	if secret != "" {
+		cfg.WebhookSecret = secret
+	}
+	if webhookURL == "" {
+		cfg.WebhookSecret = ""
+	}
 
-	if !bucket.Allow() {
-		return fmt.Errorf("rate limit exceeded")
+	configJSON, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
 	}
 
+	_, err = s.db.Exec(`UPDATE tenants SET config = ? WHERE tenant_id = ?`, string(configJSON), tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to update tenant config: %w", err)
+	}
 	return nil
 }
 
+// CheckRateLimit checks whether a request to routeKey (method + templated
+// path, e.g. RouteMessages) from clientIP is within tenantID's rate limit,
+// consulting the route's bucket, the tenant's overall bucket (sized from
+// the tenant's own TenantConfig.RateLimit if set), a per-(tenant, clientIP)
+// bucket so one abusive address can't starve the rest of the tenant's
+// traffic, and the process-wide bucket. clientIP may be the zero
+// netip.Addr (e.g. if netutil.ClientIP couldn't determine one), in which
+// case the IP tier is skipped. The returned Decision carries everything
+// the caller needs to set X-RateLimit-* and Retry-After response headers,
+// whether or not the request was allowed.
+func (s *Service) CheckRateLimit(tenantID, routeKey string, clientIP netip.Addr) ratelimit.Decision {
+	tenantLimit := ratelimit.RouteLimit{
+		Capacity:   float64(s.defaultRateLimit),
+		RefillRate: float64(s.defaultRateLimit) / 2.0,
+	}
+	if cfg, err := s.GetTenantConfig(tenantID); err == nil && cfg.RateLimit > 0 {
+		tenantLimit = ratelimit.RouteLimit{
+			Capacity:   float64(cfg.RateLimit),
+			RefillRate: float64(cfg.RateLimit) / 2.0,
+		}
+	}
+
+	if !clientIP.IsValid() {
+		return s.limiter.CheckWithTenantLimit(tenantID, routeKey, tenantLimit)
+	}
+	return s.limiter.CheckWithIPLimit(tenantID, routeKey, clientIP.String(), tenantLimit, s.ipLimit)
+}
+
+// GCRateLimits evicts rate limit buckets that haven't been touched in
+// idleTTL. Intended to be called periodically by worker.RateLimitGCWorker.
+func (s *Service) GCRateLimits(idleTTL time.Duration) {
+	s.limiter.GC(idleTTL)
+}
+
 // ListTenants returns all tenants (admin operation)
 func (s *Service) ListTenants() ([]*models.Tenant, error) {
 	query := `SELECT tenant_id, api_key, name, config, created_at FROM tenants ORDER BY created_at DESC`
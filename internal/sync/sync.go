@@ -0,0 +1,58 @@
+// Package sync implements a sliding-sync style, window-based room listing
+// protocol for chatroom lists, inspired by Matrix MSC3575. Clients subscribe
+// to one or more ordered lists and specify integer ranges identifying which
+// positions they currently care about; the server returns only the rooms in
+// those windows plus a compact op log describing how the window changed
+// since the last sync.
+package sync
+
+// Range identifies a window of positions in an ordered list, inclusive on
+// both ends (e.g. [0, 9] is the first ten rooms).
+type Range [2]int
+
+// ListRequest describes one ordered, windowed view a client wants to track.
+type ListRequest struct {
+	Ranges    []Range  `json:"ranges"`
+	Sort      string   `json:"sort"`                 // "by_recency", "by_unread", "by_name"
+	RoomTypes []string `json:"room_types,omitempty"` // optional filter, e.g. ["dm", "group"]
+}
+
+// ExtensionsRequest opts a list into hydrating extra per-room data so callers
+// avoid loading state for rooms outside their visible window.
+type ExtensionsRequest struct {
+	Typing         bool `json:"typing,omitempty"`
+	Receipts       bool `json:"receipts,omitempty"`
+	RecentMessages int  `json:"recent_messages,omitempty"` // number of trailing messages to include per room
+}
+
+// Request is the body of a sliding sync call.
+type Request struct {
+	Pos        int                          `json:"pos,omitempty"` // echoed back from the previous response for incremental sync
+	Lists      map[string]ListRequest       `json:"lists"`
+	Extensions map[string]ExtensionsRequest `json:"extensions,omitempty"` // keyed by list name
+}
+
+// Op is a single mutation the client should apply to its local sparse array
+// for a list.
+type Op struct {
+	Op      string   `json:"op"` // "SYNC", "INVALIDATE", "INSERT", "DELETE"
+	Range   *Range   `json:"range,omitempty"`
+	Index   *int     `json:"index,omitempty"`
+	RoomIDs []string `json:"room_ids,omitempty"`
+}
+
+// ListResponse carries the total count of the ordered list and the ops
+// needed to bring the client's local window up to date.
+type ListResponse struct {
+	Count int  `json:"count"`
+	Ops   []Op `json:"ops"`
+}
+
+// Response is returned from a sliding sync call. Rooms is keyed by room ID
+// and contains every room currently inside one of this response's windows.
+type Response struct {
+	Pos        int                     `json:"pos"`
+	Lists      map[string]ListResponse `json:"lists"`
+	Rooms      map[string]interface{}  `json:"rooms"`
+	Extensions map[string]interface{}  `json:"extensions,omitempty"`
+}
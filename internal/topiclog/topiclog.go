@@ -0,0 +1,203 @@
+// Package topiclog is a durable, append-only log of notification payloads
+// per (tenant, topic), backed by tidwall/wal. It gives topics crash-safe
+// delivery ordering with an O(1) append and no per-message SQL write, so a
+// topic can grow to millions of messages without the notifications table
+// becoming the bottleneck; see notification.NewService and
+// notification.Service.CreateNotification for how it fits into the rest of
+// the delivery pipeline.
+package topiclog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/wal"
+)
+
+// Entry is a single record read back from a topic's log.
+type Entry struct {
+	Seq     uint64
+	Payload []byte
+}
+
+// Log manages one WAL per (tenant, topic), opened lazily on first use and
+// kept open for the lifetime of the process.
+type Log struct {
+	baseDir string
+
+	mu    sync.Mutex
+	opens map[string]*wal.Log
+}
+
+// New creates a Log that stores its WAL segments under baseDir, one
+// subdirectory per (tenant, topic). baseDir is created if it doesn't exist.
+func New(baseDir string) *Log {
+	return &Log{baseDir: baseDir, opens: make(map[string]*wal.Log)}
+}
+
+// dirFor returns the on-disk directory for a (tenant, topic) pair. Both are
+// expected to be API-supplied identifiers, not filesystem paths, so they are
+// escaped rather than joined directly.
+func (l *Log) dirFor(tenantID, topic string) string {
+	return filepath.Join(l.baseDir, escape(tenantID), escape(topic))
+}
+
+// escape makes s safe to use as a single path component.
+func escape(s string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", "..", "__").Replace(s)
+}
+
+func (l *Log) key(tenantID, topic string) string {
+	return tenantID + "|" + topic
+}
+
+// open returns the WAL for (tenantID, topic), opening it on first access.
+func (l *Log) open(tenantID, topic string) (*wal.Log, error) {
+	key := l.key(tenantID, topic)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if w, ok := l.opens[key]; ok {
+		return w, nil
+	}
+
+	dir := l.dirFor(tenantID, topic)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create topic log directory: %w", err)
+	}
+
+	w, err := wal.Open(dir, wal.DefaultOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open topic log: %w", err)
+	}
+
+	l.opens[key] = w
+	return w, nil
+}
+
+// Append writes payload to the end of (tenantID, topic)'s log and returns
+// the sequence number it was assigned. Sequence numbers start at 1 and are
+// strictly increasing per topic.
+func (l *Log) Append(tenantID, topic string, payload []byte) (uint64, error) {
+	w, err := l.open(tenantID, topic)
+	if err != nil {
+		return 0, err
+	}
+
+	last, err := w.LastIndex()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read topic log tail: %w", err)
+	}
+	seq := last + 1
+
+	if err := w.Write(seq, payload); err != nil {
+		return 0, fmt.Errorf("failed to append to topic log: %w", err)
+	}
+	return seq, nil
+}
+
+// Read returns up to limit entries from (tenantID, topic) with Seq >
+// fromSeq, in order. It stops early, without error, once it reaches the
+// log's tail.
+func (l *Log) Read(tenantID, topic string, fromSeq uint64, limit int) ([]Entry, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+
+	w, err := l.open(tenantID, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := w.FirstIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read topic log head: %w", err)
+	}
+	last, err := w.LastIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read topic log tail: %w", err)
+	}
+
+	start := fromSeq + 1
+	if start < first {
+		start = first
+	}
+
+	var entries []Entry
+	for seq := start; seq <= last && len(entries) < limit; seq++ {
+		payload, err := w.Read(seq)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read topic log entry %d: %w", seq, err)
+		}
+		entries = append(entries, Entry{Seq: seq, Payload: payload})
+	}
+	return entries, nil
+}
+
+// LastSeq returns the most recently appended sequence number for
+// (tenantID, topic), or 0 if the topic has never been written to.
+func (l *Log) LastSeq(tenantID, topic string) (uint64, error) {
+	w, err := l.open(tenantID, topic)
+	if err != nil {
+		return 0, err
+	}
+	return w.LastIndex()
+}
+
+// Truncate drops every entry at or before minSeq from (tenantID, topic)'s
+// log, except the newest entry, which tidwall/wal can't truncate away,
+// reclaiming the disk space of WAL segments that are entirely behind
+// it. minSeq is typically the minimum committed cursor across that topic's
+// live subscribers, so nothing still-unread is ever dropped.
+func (l *Log) Truncate(tenantID, topic string, minSeq uint64) error {
+	w, err := l.open(tenantID, topic)
+	if err != nil {
+		return err
+	}
+
+	first, err := w.FirstIndex()
+	if err != nil {
+		return fmt.Errorf("failed to read topic log head: %w", err)
+	}
+	if minSeq < first {
+		return nil
+	}
+
+	last, err := w.LastIndex()
+	if err != nil {
+		return fmt.Errorf("failed to read topic log tail: %w", err)
+	}
+	if last == 0 {
+		return nil
+	}
+	if minSeq >= last {
+		minSeq = last - 1
+	}
+	if minSeq == 0 {
+		return nil
+	}
+
+	if err := w.TruncateFront(minSeq + 1); err != nil && err != wal.ErrOutOfRange {
+		return fmt.Errorf("failed to truncate topic log: %w", err)
+	}
+	return nil
+}
+
+// Close closes every WAL this Log has opened.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var firstErr error
+	for key, w := range l.opens {
+		if err := w.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to close topic log %s: %w", key, err)
+		}
+	}
+	l.opens = make(map[string]*wal.Log)
+	return firstErr
+}
@@ -4,18 +4,29 @@ import (
 	"context"
 	"log/slog"
 	"net/http"
+	"path/filepath"
 	"time"
 
+	"github.com/hastenr/chatapi/internal/broker"
 	"github.com/hastenr/chatapi/internal/config"
 	"github.com/hastenr/chatapi/internal/db"
+	"github.com/hastenr/chatapi/internal/federation"
 	"github.com/hastenr/chatapi/internal/handlers/rest"
 	"github.com/hastenr/chatapi/internal/handlers/ws"
+	"github.com/hastenr/chatapi/internal/metrics"
+	"github.com/hastenr/chatapi/internal/pubsub"
+	"github.com/hastenr/chatapi/internal/retry"
 	"github.com/hastenr/chatapi/internal/services/chatroom"
 	"github.com/hastenr/chatapi/internal/services/delivery"
 	"github.com/hastenr/chatapi/internal/services/message"
+	mwal "github.com/hastenr/chatapi/internal/services/message/wal"
 	"github.com/hastenr/chatapi/internal/services/notification"
 	"github.com/hastenr/chatapi/internal/services/realtime"
 	"github.com/hastenr/chatapi/internal/services/tenant"
+	"github.com/hastenr/chatapi/internal/topiclog"
+	"github.com/hastenr/chatapi/internal/webhook"
+	"github.com/hastenr/chatapi/internal/worker"
+	"github.com/hastenr/chatapi/internal/wssession"
 )
 
 // Server represents the HTTP server
@@ -32,14 +43,88 @@ func NewServer(
 	tenantSvc *tenant.Service,
 	realtimeSvc *realtime.Service,
 	deliverySvc *delivery.Service,
+	deliveryWorker *worker.DeliveryWorker,
+	bus *pubsub.Bus,
 ) *Server {
 	// Create handlers
-	chatroomSvc := chatroom.NewService(db.DB)
-	messageSvc := message.NewService(db.DB)
-	notifSvc := notification.NewService(db.DB)
+	chatroomSvc := chatroom.NewService(db.DB, bus)
+
+	// Each room gets its own append-only WAL segment under DataDir/messages;
+	// see message/wal.Log's doc comment for why SendMessage writes there
+	// before SQLite. RecoverSequences reconciles rooms.last_seq with
+	// whatever made it to disk before an unclean shutdown.
+	messageLog := mwal.New(filepath.Join(cfg.DataDir, "messages"))
+	messageSvc := message.NewService(db.DB, messageLog)
+	if err := messageSvc.RecoverSequences(); err != nil {
+		slog.Error("Failed to recover message log sequences", "error", err)
+	}
 
-	restHandler := rest.NewHandler(tenantSvc, chatroomSvc, messageSvc, realtimeSvc, deliverySvc, notifSvc, cfg)
-	wsHandler := ws.NewHandler(tenantSvc, chatroomSvc, messageSvc, realtimeSvc)
+	// Each notification topic gets its own append-only WAL segment under
+	// DataDir/topics; see topiclog.Log's doc comment for why this backs
+	// replay/truncation instead of relying on the notifications table alone.
+	topicLog := topiclog.New(filepath.Join(cfg.DataDir, "topics"))
+	notifSvc := notification.NewService(db.DB, bus, topicLog)
+
+	// Backplane fans messages, acks, and presence out across nodes sharing a
+	// broker.Broker; see realtime.Backplane's doc comment for how that
+	// relates to the in-process pubsub.Bus used everywhere else in this
+	// function. NewInProcess keeps today's single-node behavior; a cluster
+	// deployment swaps this for broker.NewNATS (build tag "nats") without
+	// touching Backplane.
+	backplane := realtime.NewBackplane(db.DB, broker.NewInProcess(), realtimeSvc, cfg.NodeID)
+	realtimeSvc.SetBackplane(backplane)
+	if err := backplane.Start(context.Background()); err != nil {
+		slog.Error("Failed to start realtime backplane", "error", err)
+	}
+
+	// Wake the delivery worker as soon as new work is inserted instead of
+	// waiting for its next poll
+	messageSvc.SetWaker(deliveryWorker)
+	notifSvc.SetWaker(deliveryWorker)
+
+	// Configure shared exponential backoff retry policy from config
+	retryPolicy := retry.Policy{
+		MaxAttempts:  cfg.RetryMaxAttempts,
+		BaseInterval: cfg.RetryInterval,
+		MaxBackoff:   cfg.RetryMaxBackoff,
+		Jitter:       cfg.RetryJitter,
+	}
+	notifSvc.SetRetryPolicy(retryPolicy)
+	deliverySvc.SetRetryPolicy(retryPolicy)
+	deliverySvc.SetNotificationService(notifSvc)
+	deliverySvc.SetMessageService(messageSvc)
+	deliverySvc.SetTenantService(tenantSvc)
+
+	// Webhook deliveries get their own backoff policy (longer base interval
+	// than in-app retries - subscriber endpoints are expected to be flakier
+	// than our own storage) and are provisioned as soon as a notification is
+	// created, then drained by the delivery worker alongside everything else.
+	webhookSvc := webhook.NewService(db.DB, tenantSvc, cfg.WebhookWorkers)
+	webhookSvc.SetRetryPolicy(retry.Policy{
+		MaxAttempts:  cfg.RetryMaxAttempts,
+		BaseInterval: cfg.RetryInterval,
+		MaxBackoff:   cfg.RetryMaxBackoff,
+		Jitter:       cfg.RetryJitter,
+	})
+	webhookSvc.SubscribeBus(context.Background(), bus)
+	deliveryWorker.SetWebhookService(webhookSvc)
+
+	// Federation relays messages in rooms shared with other ChatAPI
+	// deployments; see federation.Service's doc comment for the
+	// Matrix-server-server-style signing scheme. It gets its own retry
+	// policy and is drained by the delivery worker like everything else.
+	federationSvc := federation.NewService(db.DB, messageSvc, cfg.FederationServerName, cfg.FederationWorkers)
+	federationSvc.SetRetryPolicy(retryPolicy)
+	deliveryWorker.SetFederationService(federationSvc)
+
+	// Resumable WebSocket sessions (Discord gateway-style disconnect/resume);
+	// see wssession.Store's doc comment. GC'd on the same schedule as the
+	// rest of this function's background wiring.
+	wsSessions := wssession.NewStore(db.DB, cfg.WSSessionTTL)
+	go worker.NewWSSessionGCWorker(wsSessions, cfg.WSSessionGCInterval).Start(context.Background())
+
+	restHandler := rest.NewHandler(tenantSvc, chatroomSvc, messageSvc, realtimeSvc, deliverySvc, notifSvc, webhookSvc, federationSvc, cfg)
+	wsHandler := ws.NewHandler(tenantSvc, chatroomSvc, messageSvc, realtimeSvc, notifSvc, webhookSvc, wsSessions, cfg.WSResumeMaxReplay, cfg.WSCompressionThreshold, cfg.TrustedProxies)
 
 	// Create mux and register routes
 	mux := http.NewServeMux()
@@ -49,25 +134,45 @@ func NewServer(
 	protectedMux.HandleFunc("POST /rooms", restHandler.AuthMiddleware(restHandler.HandleCreateRoom))
 	protectedMux.HandleFunc("GET /rooms/{room_id}", restHandler.AuthMiddleware(restHandler.HandleGetRoom))
 	protectedMux.HandleFunc("GET /rooms/{room_id}/members", restHandler.AuthMiddleware(restHandler.HandleGetRoomMembers))
+	protectedMux.HandleFunc("POST /sync", restHandler.AuthMiddleware(restHandler.HandleSlidingSync))
 	protectedMux.HandleFunc("POST /rooms/{room_id}/messages", restHandler.AuthMiddleware(restHandler.HandleSendMessage))
 	protectedMux.HandleFunc("GET /rooms/{room_id}/messages", restHandler.AuthMiddleware(restHandler.HandleGetMessages))
 	protectedMux.HandleFunc("POST /acks", restHandler.AuthMiddleware(restHandler.HandleAck))
 	protectedMux.HandleFunc("POST /notify", restHandler.AuthMiddleware(restHandler.HandleNotify))
+	protectedMux.HandleFunc("GET /topics/{topic}/messages", restHandler.AuthMiddleware(restHandler.HandleGetTopicMessages))
 	protectedMux.HandleFunc("GET /admin/dead-letters", restHandler.AuthMiddleware(restHandler.HandleGetDeadLetters))
+	protectedMux.HandleFunc("GET /admin/messages/dead-letter", restHandler.AuthMiddleware(restHandler.HandleListMessageDeadLetters))
+	protectedMux.HandleFunc("POST /admin/messages/dead-letter/{id}/requeue", restHandler.AuthMiddleware(restHandler.HandleRequeueMessageDeadLetter))
 
 	// Register public routes
 	mux.HandleFunc("GET /health", restHandler.HandleHealth)
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.HandleFunc("GET /debug/wire-stats", restHandler.HandleWireStats)
 	mux.HandleFunc("GET /ws", wsHandler.HandleConnection)
 
-	// Mount protected routes with auth middleware
-	mux.Handle("/", restHandler.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		protectedMux.ServeHTTP(w, r)
-	}))
-
-	// Create HTTP server
+	// Admin routes gate on X-Master-Key themselves rather than AuthMiddleware's
+	// per-tenant X-API-Key, so they're registered directly on mux.
+	mux.HandleFunc("POST /admin/tenants/{tenant_id}/webhook", restHandler.HandleConfigureWebhook)
+	mux.HandleFunc("POST /admin/federation/peers", restHandler.HandleRegisterFederationPeer)
+	mux.HandleFunc("POST /admin/tenants/{tenant_id}/rooms/{room_id}/federation", restHandler.HandleFederateRoom)
+
+	// Federation routes authenticate peer servers via
+	// X-Federation-Server/X-Federation-Signature themselves, not a tenant
+	// X-API-Key, so they're also registered directly on mux.
+	mux.HandleFunc("POST /_federation/send", restHandler.HandleFederationSend)
+	mux.HandleFunc("GET /_federation/backfill", restHandler.HandleFederationBackfill)
+
+	// Mount protected routes. AuthMiddleware is already applied per-route
+	// above (not wrapped again here) so http.Request.Pattern reflects the
+	// matched protected route, not "/", when rate limiting keys its bucket.
+	mux.Handle("/", protectedMux)
+
+	// Create HTTP server. InstrumentHTTP wraps the whole mux (not an
+	// individual route) so it reads r.Pattern, set by http.ServeMux's
+	// dispatch, only after that dispatch has already happened.
 	httpServer := &http.Server{
 		Addr:         cfg.ListenAddr,
-		Handler:      mux,
+		Handler:      metrics.InstrumentHTTP(mux),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
@@ -0,0 +1,245 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventEnvelope is the JSON body posted to a tenant's configured event
+// webhook URL (see tenant.TenantConfig.WebhookURL), modeled on Spreed's
+// backend-server webhook flow: Random binds into the signature so the
+// same event can't be replayed against a different body.
+type eventEnvelope struct {
+	Type      string      `json:"type"`
+	TenantID  string      `json:"tenant_id"`
+	RoomID    string      `json:"room_id,omitempty"`
+	Data      interface{} `json:"data"`
+	Timestamp int64       `json:"timestamp"`
+	Random    string      `json:"random"`
+}
+
+// DispatchEvent enqueues eventType for delivery to tenantID's configured
+// webhook URL, if any; it is a no-op if the tenant hasn't configured one.
+// Delivery itself happens asynchronously via ProcessPendingEvents, same as
+// subscription-based notification webhooks, so a slow or unreachable
+// endpoint never blocks the caller (message send, ack, presence update,
+// room create).
+func (s *Service) DispatchEvent(tenantID, eventType, roomID string, data interface{}) error {
+	cfg, err := s.tenantSvc.GetTenantConfig(tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to load tenant config: %w", err)
+	}
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+
+	envelope := eventEnvelope{
+		Type:      eventType,
+		TenantID:  tenantID,
+		RoomID:    roomID,
+		Data:      data,
+		Timestamp: time.Now().Unix(),
+		Random:    generateRandomHex(16),
+	}
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return fmt.Errorf("failed to encode event webhook payload: %w", err)
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO event_webhook_deliveries (tenant_id, event_type, room_id, payload, status)
+		VALUES (?, ?, ?, ?, 'pending')
+	`, tenantID, eventType, roomID, string(payload))
+	if err != nil {
+		return fmt.Errorf("failed to enqueue event webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// pendingEventDelivery is a single row pulled from event_webhook_deliveries,
+// ready to be attempted.
+type pendingEventDelivery struct {
+	id      int
+	payload string
+}
+
+// ProcessPendingEvents attempts delivery of every event_webhook_deliveries
+// row for tenantID that is pending and due for (re)try, up to limit rows,
+// dispatching endpoint calls concurrently bounded by s.workers.
+func (s *Service) ProcessPendingEvents(tenantID string, limit int) error {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id, payload
+		FROM event_webhook_deliveries
+		WHERE tenant_id = ? AND status = 'pending'
+			AND (next_retry_at IS NULL OR next_retry_at <= CURRENT_TIMESTAMP)
+		ORDER BY created_at ASC
+		LIMIT ?
+	`, tenantID, limit)
+	if err != nil {
+		return fmt.Errorf("failed to get pending event webhook deliveries: %w", err)
+	}
+
+	var pending []pendingEventDelivery
+	for rows.Next() {
+		var d pendingEventDelivery
+		if err := rows.Scan(&d.id, &d.payload); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan event webhook delivery: %w", err)
+		}
+		pending = append(pending, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	cfg, err := s.tenantSvc.GetTenantConfig(tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to load tenant config: %w", err)
+	}
+	if cfg.WebhookURL == "" {
+		// Tenant disabled its webhook after these were enqueued; leave them
+		// pending rather than silently dropping them in case it's re-enabled.
+		return nil
+	}
+
+	sem := make(chan struct{}, s.workers)
+	var wg sync.WaitGroup
+
+	for _, d := range pending {
+		d := d
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := s.attemptEvent(d, cfg.WebhookURL, cfg.WebhookSecret); err != nil {
+				slog.Warn("Event webhook delivery failed", "delivery_id", d.id, "error", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// attemptEvent POSTs a single event delivery's payload to webhookURL, signed
+// with secret over its embedded random value, and records the outcome.
+func (s *Service) attemptEvent(d pendingEventDelivery, webhookURL, secret string) error {
+	var envelope eventEnvelope
+	if err := json.Unmarshal([]byte(d.payload), &envelope); err != nil {
+		return s.markEventFailed(d.id, fmt.Sprintf("failed to decode stored payload: %v", err))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader([]byte(d.payload)))
+	if err != nil {
+		return s.markEventFailed(d.id, fmt.Sprintf("failed to build request: %v", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature", "sha256="+signEvent(secret, envelope.Random, d.payload))
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return s.markEventFailed(d.id, err.Error())
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return s.markEventDelivered(d.id)
+	}
+
+	return s.markEventFailed(d.id, fmt.Sprintf("endpoint returned status %d", resp.StatusCode))
+}
+
+// signEvent computes the HMAC-SHA256 signature for an event webhook body,
+// binding in the envelope's random value so a captured request can't be
+// replayed against a different body.
+func signEvent(secret, random, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(random + ":" + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Service) markEventDelivered(id int) error {
+	_, err := s.db.Exec(`
+		UPDATE event_webhook_deliveries
+		SET status = 'delivered', attempts = attempts + 1, last_attempt_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, id)
+	return err
+}
+
+// markEventFailed bumps the attempt counter with exponential backoff, or
+// moves the delivery to the dead letter table once it exhausts its attempts.
+func (s *Service) markEventFailed(id int, lastErr string) error {
+	var attempts int
+	if err := s.db.QueryRow(`SELECT attempts FROM event_webhook_deliveries WHERE id = ?`, id).Scan(&attempts); err != nil {
+		return err
+	}
+
+	if s.retryPolicy.IsTerminal(attempts) {
+		return s.moveEventToDeadLetter(id, attempts+1, lastErr)
+	}
+
+	nextRetryAt := s.retryPolicy.NextRetryAt(attempts, time.Now())
+	_, err := s.db.Exec(`
+		UPDATE event_webhook_deliveries
+		SET attempts = attempts + 1, last_attempt_at = CURRENT_TIMESTAMP, next_retry_at = ?, last_error = ?
+		WHERE id = ?
+	`, nextRetryAt, lastErr, id)
+	return err
+}
+
+func (s *Service) moveEventToDeadLetter(id, attempts int, lastErr string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE event_webhook_deliveries
+		SET status = 'dead', attempts = ?, last_attempt_at = CURRENT_TIMESTAMP, last_error = ?
+		WHERE id = ?
+	`, attempts, lastErr, id)
+	if err != nil {
+		return fmt.Errorf("failed to mark event delivery dead: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO dead_letter (tenant_id, kind, ref_id, payload, last_error, attempts)
+		SELECT tenant_id, 'webhook_delivery', CAST(id AS TEXT), event_type, ?, ?
+		FROM event_webhook_deliveries WHERE id = ?
+	`, lastErr, attempts, id)
+	if err != nil {
+		return fmt.Errorf("failed to insert dead letter entry: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func generateRandomHex(length int) string {
+	bytes := make([]byte, length)
+	if _, err := rand.Read(bytes); err != nil {
+		panic("failed to generate random bytes")
+	}
+	return hex.EncodeToString(bytes)
+}
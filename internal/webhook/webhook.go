@@ -0,0 +1,305 @@
+// Package webhook delivers notifications to subscriber-provided HTTP
+// endpoints (models.NotificationSubscription.Endpoint), signing each payload
+// with the tenant's API key so the receiver can verify it came from
+// ChatAPI. Delivery is tracked per-subscription in notification_deliveries,
+// independent of the parent notification's own status, so a slow or broken
+// endpoint keeps retrying on its own backoff schedule.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hastenr/chatapi/internal/models"
+	"github.com/hastenr/chatapi/internal/pubsub"
+	"github.com/hastenr/chatapi/internal/retry"
+	"github.com/hastenr/chatapi/internal/services/tenant"
+)
+
+// defaultRetryPolicy is used until SetRetryPolicy is called with values from
+// config.Config.
+var defaultRetryPolicy = retry.Policy{
+	MaxAttempts:  5,
+	BaseInterval: 30 * time.Second,
+	MaxBackoff:   1 * time.Hour,
+	Jitter:       0.2,
+}
+
+// Service delivers notifications to webhook subscriptions. HTTP calls to
+// subscriber endpoints are bounded by a worker pool so one slow endpoint
+// can't stall delivery to the rest.
+type Service struct {
+	db          *sql.DB
+	tenantSvc   *tenant.Service
+	httpClient  *http.Client
+	retryPolicy retry.Policy
+	workers     int
+}
+
+// NewService creates a new webhook delivery service. workers bounds how many
+// endpoints are called concurrently per ProcessPending batch.
+func NewService(db *sql.DB, tenantSvc *tenant.Service, workers int) *Service {
+	if workers <= 0 {
+		workers = 4
+	}
+	return &Service{
+		db:          db,
+		tenantSvc:   tenantSvc,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+		retryPolicy: defaultRetryPolicy,
+		workers:     workers,
+	}
+}
+
+// SetRetryPolicy overrides the exponential backoff policy used for webhook
+// retries.
+func (s *Service) SetRetryPolicy(p retry.Policy) {
+	s.retryPolicy = p
+}
+
+// SubscribeBus provisions a notification_deliveries row for every webhook
+// subscription matching a notification's topic as soon as it's created,
+// instead of waiting for the next full scan.
+func (s *Service) SubscribeBus(ctx context.Context, bus *pubsub.Bus) {
+	ch, cancel := bus.Subscribe("", "notification.created")
+
+	go func() {
+		defer cancel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-ch:
+				if !ok {
+					return
+				}
+				notif, ok := event.Payload.(*models.Notification)
+				if !ok {
+					continue
+				}
+				if err := s.ProvisionDeliveries(notif); err != nil {
+					slog.Error("Failed to provision webhook deliveries", "error", err, "notification_id", notif.NotificationID)
+				}
+			}
+		}
+	}()
+}
+
+// ProvisionDeliveries inserts a pending notification_deliveries row for
+// every subscription on notif's topic that has a webhook endpoint
+// configured.
+func (s *Service) ProvisionDeliveries(notif *models.Notification) error {
+	rows, err := s.db.Query(`
+		SELECT id, endpoint
+		FROM notification_subscriptions
+		WHERE tenant_id = ? AND topic = ? AND endpoint != ''
+	`, notif.TenantID, notif.Topic)
+	if err != nil {
+		return fmt.Errorf("failed to load webhook subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	type subscription struct {
+		id       int
+		endpoint string
+	}
+	var subs []subscription
+	for rows.Next() {
+		var sub subscription
+		if err := rows.Scan(&sub.id, &sub.endpoint); err != nil {
+			return fmt.Errorf("failed to scan subscription: %w", err)
+		}
+		subs = append(subs, sub)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, sub := range subs {
+		_, err := s.db.Exec(`
+			INSERT INTO notification_deliveries (tenant_id, notification_id, subscription_id, endpoint, status)
+			VALUES (?, ?, ?, ?, 'pending')
+		`, notif.TenantID, notif.NotificationID, sub.id, sub.endpoint)
+		if err != nil {
+			return fmt.Errorf("failed to provision delivery for subscription %d: %w", sub.id, err)
+		}
+	}
+
+	return nil
+}
+
+// pendingDelivery is a single row pulled from notification_deliveries, ready
+// to be attempted.
+type pendingDelivery struct {
+	id       int
+	endpoint string
+	payload  string
+}
+
+// ProcessPending attempts delivery of every notification_deliveries row for
+// tenantID that is pending and due for (re)try, up to limit rows,
+// dispatching endpoint calls concurrently bounded by s.workers.
+func (s *Service) ProcessPending(tenantID string, limit int) error {
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	rows, err := s.db.Query(`
+		SELECT nd.id, nd.endpoint, n.payload
+		FROM notification_deliveries nd
+		JOIN notifications n ON n.notification_id = nd.notification_id
+		WHERE nd.tenant_id = ? AND nd.status = 'pending'
+			AND (nd.next_retry_at IS NULL OR nd.next_retry_at <= CURRENT_TIMESTAMP)
+		ORDER BY nd.created_at ASC
+		LIMIT ?
+	`, tenantID, limit)
+	if err != nil {
+		return fmt.Errorf("failed to get pending webhook deliveries: %w", err)
+	}
+
+	var pending []pendingDelivery
+	for rows.Next() {
+		var d pendingDelivery
+		if err := rows.Scan(&d.id, &d.endpoint, &d.payload); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		pending = append(pending, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	tenantRecord, err := s.tenantSvc.GetTenantByID(tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to load tenant: %w", err)
+	}
+
+	sem := make(chan struct{}, s.workers)
+	var wg sync.WaitGroup
+
+	for _, d := range pending {
+		d := d
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := s.attempt(d, tenantRecord.APIKey); err != nil {
+				slog.Warn("Webhook delivery failed", "delivery_id", d.id, "endpoint", d.endpoint, "error", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// attempt POSTs a single delivery's payload to its endpoint, signed with
+// apiKey, and records the outcome.
+func (s *Service) attempt(d pendingDelivery, apiKey string) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := sign(apiKey, timestamp, d.payload)
+
+	req, err := http.NewRequest(http.MethodPost, d.endpoint, bytes.NewReader([]byte(d.payload)))
+	if err != nil {
+		return s.markFailed(d.id, fmt.Sprintf("failed to build request: %v", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-ChatAPI-Signature", "sha256="+signature)
+	req.Header.Set("X-ChatAPI-Timestamp", timestamp)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return s.markFailed(d.id, err.Error())
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return s.markDelivered(d.id)
+	}
+
+	return s.markFailed(d.id, fmt.Sprintf("endpoint returned status %d", resp.StatusCode))
+}
+
+// sign computes the HMAC-SHA256 signature for a webhook payload, binding in
+// the timestamp so a captured request can't be replayed indefinitely.
+func sign(apiKey, timestamp, payload string) string {
+	mac := hmac.New(sha256.New, []byte(apiKey))
+	mac.Write([]byte(timestamp + "." + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Service) markDelivered(id int) error {
+	_, err := s.db.Exec(`
+		UPDATE notification_deliveries
+		SET status = 'delivered', attempts = attempts + 1, last_attempt_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, id)
+	return err
+}
+
+// markFailed bumps the attempt counter with exponential backoff, or moves
+// the delivery to the dead letter table once it exhausts its attempts.
+func (s *Service) markFailed(id int, lastErr string) error {
+	var attempts int
+	if err := s.db.QueryRow(`SELECT attempts FROM notification_deliveries WHERE id = ?`, id).Scan(&attempts); err != nil {
+		return err
+	}
+
+	if s.retryPolicy.IsTerminal(attempts) {
+		return s.moveToDeadLetter(id, attempts+1, lastErr)
+	}
+
+	nextRetryAt := s.retryPolicy.NextRetryAt(attempts, time.Now())
+	_, err := s.db.Exec(`
+		UPDATE notification_deliveries
+		SET attempts = attempts + 1, last_attempt_at = CURRENT_TIMESTAMP, next_retry_at = ?, last_error = ?
+		WHERE id = ?
+	`, nextRetryAt, lastErr, id)
+	return err
+}
+
+func (s *Service) moveToDeadLetter(id, attempts int, lastErr string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE notification_deliveries
+		SET status = 'dead', attempts = ?, last_attempt_at = CURRENT_TIMESTAMP, last_error = ?
+		WHERE id = ?
+	`, attempts, lastErr, id)
+	if err != nil {
+		return fmt.Errorf("failed to mark delivery dead: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO dead_letter (tenant_id, kind, ref_id, payload, last_error, attempts)
+		SELECT tenant_id, 'webhook_delivery', CAST(id AS TEXT), endpoint, ?, ?
+		FROM notification_deliveries WHERE id = ?
+	`, lastErr, attempts, id)
+	if err != nil {
+		return fmt.Errorf("failed to insert dead letter entry: %w", err)
+	}
+
+	return tx.Commit()
+}
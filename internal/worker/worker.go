@@ -1,148 +1,390 @@
 package worker
 
 import (
-"context"
-"log/slog"
-"time"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
 
-"github.com/hastenr/chatapi/internal/db"
-"github.com/hastenr/chatapi/internal/services/delivery"
+	"github.com/hastenr/chatapi/internal/db"
+	"github.com/hastenr/chatapi/internal/federation"
+	"github.com/hastenr/chatapi/internal/pubsub"
+	"github.com/hastenr/chatapi/internal/services/delivery"
+	"github.com/hastenr/chatapi/internal/services/tenant"
+	"github.com/hastenr/chatapi/internal/webhook"
+	"github.com/hastenr/chatapi/internal/wssession"
 )
 
-// DeliveryWorker processes undelivered messages and notifications
+// DeliveryWorker processes undelivered messages and notifications. Instead of
+// scanning every tenant on a fixed tick, it long-polls: WakeUp records which
+// tenants have new work, and a debounce window coalesces bursty wakeups into
+// a single batch scan of just the dirty tenants. The ticker interval acts as
+// a long upper bound so work is never delayed indefinitely if a wakeup is
+// missed. Tenants within a batch are processed concurrently, bounded by
+// concurrency, so one tenant with a deep backlog can't stall delivery to
+// the rest.
 type DeliveryWorker struct {
-db          *db.DB
-deliverySvc *delivery.Service
-interval    time.Duration
-stopCh      chan struct{}
+	db            *db.DB
+	deliverySvc   *delivery.Service
+	webhookSvc    *webhook.Service
+	federationSvc *federation.Service
+	interval      time.Duration
+	debounce      time.Duration
+	concurrency   int
+	stopCh        chan struct{}
+	wakeCh        chan struct{}
+
+	mu    sync.Mutex
+	dirty map[string]struct{}
 }
 
-// NewDeliveryWorker creates a new delivery worker
-func NewDeliveryWorker(db *db.DB, deliverySvc *delivery.Service, interval time.Duration) *DeliveryWorker {
-return &DeliveryWorker{
-db:          db,
-deliverySvc: deliverySvc,
-interval:    interval,
-stopCh:      make(chan struct{}),
+// NewDeliveryWorker creates a new delivery worker. concurrency bounds how
+// many tenants are scanned in parallel per batch.
+func NewDeliveryWorker(db *db.DB, deliverySvc *delivery.Service, interval, debounce time.Duration, concurrency int) *DeliveryWorker {
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	return &DeliveryWorker{
+		db:          db,
+		deliverySvc: deliverySvc,
+		interval:    interval,
+		debounce:    debounce,
+		concurrency: concurrency,
+		stopCh:      make(chan struct{}),
+		wakeCh:      make(chan struct{}, 1),
+		dirty:       make(map[string]struct{}),
+	}
 }
+
+// SetWebhookService registers the webhook delivery service whose pending
+// deliveries are processed alongside undelivered messages and notifications
+// for each tenant. Webhook delivery is skipped if this is never called.
+func (w *DeliveryWorker) SetWebhookService(svc *webhook.Service) {
+	w.webhookSvc = svc
 }
 
-// Start starts the delivery worker
-func (w *DeliveryWorker) Start(ctx context.Context) {
-slog.Info("Starting delivery worker", "interval", w.interval)
+// SetFederationService registers the federation service whose pending
+// peer relays are processed alongside everything else for each tenant.
+// Federation relay is skipped if this is never called.
+func (w *DeliveryWorker) SetFederationService(svc *federation.Service) {
+	w.federationSvc = svc
+}
 
-ticker := time.NewTicker(w.interval)
-defer ticker.Stop()
+// WakeUp marks tenantID as having new work and nudges the worker to scan it
+// soon. Call this whenever a message or notification is inserted. It never
+// blocks: bursts of wakeups coalesce into a single pending signal.
+func (w *DeliveryWorker) WakeUp(tenantID string) {
+	w.mu.Lock()
+	w.dirty[tenantID] = struct{}{}
+	w.mu.Unlock()
 
-for {
-select {
-case <-ctx.Done():
-slog.Info("Delivery worker stopped")
-return
-case <-w.stopCh:
-slog.Info("Delivery worker stopped")
-return
-case <-ticker.C:
-w.processBatch()
+	select {
+	case w.wakeCh <- struct{}{}:
+	default:
+	}
 }
+
+// SubscribeBus wakes the worker for a tenant whenever bus publishes a
+// "notification.created" event, as an alternative to services calling
+// WakeUp directly. It is a best-effort complement, not a replacement: the
+// subscription is dropped when ctx is cancelled.
+func (w *DeliveryWorker) SubscribeBus(ctx context.Context, bus *pubsub.Bus) {
+	ch, cancel := bus.Subscribe("", "notification.created")
+
+	go func() {
+		defer cancel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-ch:
+				if !ok {
+					return
+				}
+				w.WakeUp(event.TenantID)
+			}
+		}
+	}()
 }
+
+// Start starts the delivery worker
+func (w *DeliveryWorker) Start(ctx context.Context) {
+	slog.Info("Starting delivery worker", "interval", w.interval, "debounce", w.debounce)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	var debounceTimer *time.Timer
+	var debounceCh <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Delivery worker stopped")
+			return
+		case <-w.stopCh:
+			slog.Info("Delivery worker stopped")
+			return
+		case <-w.wakeCh:
+			if debounceTimer == nil {
+				debounceTimer = time.NewTimer(w.debounce)
+				debounceCh = debounceTimer.C
+			}
+		case <-debounceCh:
+			debounceTimer = nil
+			debounceCh = nil
+			w.processDirtyTenants()
+		case <-ticker.C:
+			// Long-poll timeout: fall back to a full scan in case a wakeup
+			// was dropped or a tenant never calls WakeUp.
+			w.processBatch()
+		}
+	}
 }
 
 // Stop stops the delivery worker
 func (w *DeliveryWorker) Stop() {
-close(w.stopCh)
+	close(w.stopCh)
+}
+
+// processDirtyTenants drains the dirty set and processes only those tenants
+func (w *DeliveryWorker) processDirtyTenants() {
+	w.mu.Lock()
+	tenants := make([]string, 0, len(w.dirty))
+	for tenantID := range w.dirty {
+		tenants = append(tenants, tenantID)
+	}
+	w.dirty = make(map[string]struct{})
+	w.mu.Unlock()
+
+	w.processTenants(tenants)
 }
 
 // processBatch processes a batch of undelivered messages and notifications
+// for every known tenant
 func (w *DeliveryWorker) processBatch() {
-// Query all tenants from database
-tenants, err := w.getAllTenants()
-if err != nil {
-slog.Error("Failed to get tenants for processing", "error", err)
-return
-}
+	// Query all tenants from database
+	tenants, err := w.getAllTenants()
+	if err != nil {
+		slog.Error("Failed to get tenants for processing", "error", err)
+		return
+	}
 
-// Process each tenant
-for _, tenantID := range tenants {
-// Process undelivered messages
-if err := w.deliverySvc.ProcessUndeliveredMessages(tenantID, 50); err != nil {
-slog.Error("Failed to process undelivered messages", "error", err, "tenant_id", tenantID)
-}
+	w.mu.Lock()
+	w.dirty = make(map[string]struct{})
+	w.mu.Unlock()
 
-// Process notifications
-if err := w.deliverySvc.ProcessNotifications(tenantID, 50); err != nil {
-slog.Error("Failed to process notifications", "error", err, "tenant_id", tenantID)
+	w.processTenants(tenants)
 }
 
-// Cleanup old entries (older than 30 days)
-if err := w.deliverySvc.CleanupOldEntries(tenantID, 30*24*time.Hour); err != nil {
-slog.Error("Failed to cleanup old entries", "error", err, "tenant_id", tenantID)
-}
+// processTenants runs processTenant for each tenant concurrently, bounded by
+// w.concurrency, so a tenant with a deep backlog can't starve the rest.
+func (w *DeliveryWorker) processTenants(tenants []string) {
+	sem := make(chan struct{}, w.concurrency)
+	var wg sync.WaitGroup
+
+	for _, tenantID := range tenants {
+		tenantID := tenantID
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			w.processTenant(tenantID)
+		}()
+	}
+
+	wg.Wait()
 }
+
+// processTenant processes undelivered messages and notifications for a
+// single tenant
+func (w *DeliveryWorker) processTenant(tenantID string) {
+	// Process undelivered messages
+	if err := w.deliverySvc.ProcessUndeliveredMessages(tenantID, 50); err != nil {
+		slog.Error("Failed to process undelivered messages", "error", err, "tenant_id", tenantID)
+	}
+
+	// Process notifications
+	if err := w.deliverySvc.ProcessNotifications(tenantID, 50); err != nil {
+		slog.Error("Failed to process notifications", "error", err, "tenant_id", tenantID)
+	}
+
+	// Process pending webhook deliveries
+	if w.webhookSvc != nil {
+		if err := w.webhookSvc.ProcessPending(tenantID, 50); err != nil {
+			slog.Error("Failed to process webhook deliveries", "error", err, "tenant_id", tenantID)
+		}
+		if err := w.webhookSvc.ProcessPendingEvents(tenantID, 50); err != nil {
+			slog.Error("Failed to process event webhook deliveries", "error", err, "tenant_id", tenantID)
+		}
+	}
+
+	// Process pending federation relays
+	if w.federationSvc != nil {
+		if err := w.federationSvc.ProcessPending(tenantID, 50); err != nil {
+			slog.Error("Failed to process federation relays", "error", err, "tenant_id", tenantID)
+		}
+	}
+
+	// Cleanup old entries (older than 30 days)
+	if err := w.deliverySvc.CleanupOldEntries(tenantID, 30*24*time.Hour); err != nil {
+		slog.Error("Failed to cleanup old entries", "error", err, "tenant_id", tenantID)
+	}
 }
 
 // getAllTenants retrieves all tenant IDs from the database
 func (w *DeliveryWorker) getAllTenants() ([]string, error) {
-query := `SELECT tenant_id FROM tenants ORDER BY tenant_id`
+	query := `SELECT tenant_id FROM tenants ORDER BY tenant_id`
 
-rows, err := w.db.DB.Query(query)
-if err != nil {
-return nil, err
-}
-defer rows.Close()
+	rows, err := w.db.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-var tenants []string
-for rows.Next() {
-var tenantID string
-if err := rows.Scan(&tenantID); err != nil {
-return nil, err
-}
-tenants = append(tenants, tenantID)
-}
+	var tenants []string
+	for rows.Next() {
+		var tenantID string
+		if err := rows.Scan(&tenantID); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenantID)
+	}
 
-return tenants, rows.Err()
+	return tenants, rows.Err()
 }
 
 // WALCheckpointWorker performs periodic WAL checkpoints
 type WALCheckpointWorker struct {
-db      *db.DB
-interval time.Duration
-stopCh   chan struct{}
+	db       *db.DB
+	interval time.Duration
+	stopCh   chan struct{}
 }
 
 // NewWALCheckpointWorker creates a new WAL checkpoint worker
 func NewWALCheckpointWorker(database *db.DB, interval time.Duration) *WALCheckpointWorker {
-return &WALCheckpointWorker{
-db:       database,
-interval: interval,
-stopCh:   make(chan struct{}),
-}
+	return &WALCheckpointWorker{
+		db:       database,
+		interval: interval,
+		stopCh:   make(chan struct{}),
+	}
 }
 
 // Start starts the WAL checkpoint worker
 func (w *WALCheckpointWorker) Start(ctx context.Context) {
-slog.Info("Starting WAL checkpoint worker", "interval", w.interval)
+	slog.Info("Starting WAL checkpoint worker", "interval", w.interval)
 
-ticker := time.NewTicker(w.interval)
-defer ticker.Stop()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
 
-for {
-select {
-case <-ctx.Done():
-slog.Info("WAL checkpoint worker stopped")
-return
-case <-w.stopCh:
-slog.Info("WAL checkpoint worker stopped")
-return
-case <-ticker.C:
-if err := db.CheckpointWAL(w.db); err != nil {
-slog.Error("Failed to checkpoint WAL", "error", err)
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("WAL checkpoint worker stopped")
+			return
+		case <-w.stopCh:
+			slog.Info("WAL checkpoint worker stopped")
+			return
+		case <-ticker.C:
+			if err := db.CheckpointWAL(w.db); err != nil {
+				slog.Error("Failed to checkpoint WAL", "error", err)
+			}
+		}
+	}
 }
+
+// Stop stops the WAL checkpoint worker
+func (w *WALCheckpointWorker) Stop() {
+	close(w.stopCh)
 }
+
+// RateLimitGCWorker periodically evicts idle rate limit buckets so
+// tenant.Service's limiter doesn't grow a bucket per (tenant, route) pair
+// forever.
+type RateLimitGCWorker struct {
+	tenantSvc *tenant.Service
+	interval  time.Duration
+	idleTTL   time.Duration
+	stopCh    chan struct{}
 }
+
+// NewRateLimitGCWorker creates a new rate limit bucket GC worker.
+func NewRateLimitGCWorker(tenantSvc *tenant.Service, interval, idleTTL time.Duration) *RateLimitGCWorker {
+	return &RateLimitGCWorker{
+		tenantSvc: tenantSvc,
+		interval:  interval,
+		idleTTL:   idleTTL,
+		stopCh:    make(chan struct{}),
+	}
 }
 
-// Stop stops the WAL checkpoint worker
-func (w *WALCheckpointWorker) Stop() {
-close(w.stopCh)
+// Start starts the rate limit bucket GC worker
+func (w *RateLimitGCWorker) Start(ctx context.Context) {
+	slog.Info("Starting rate limit GC worker", "interval", w.interval, "idle_ttl", w.idleTTL)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Rate limit GC worker stopped")
+			return
+		case <-w.stopCh:
+			slog.Info("Rate limit GC worker stopped")
+			return
+		case <-ticker.C:
+			w.tenantSvc.GCRateLimits(w.idleTTL)
+		}
+	}
+}
+
+// Stop stops the rate limit bucket GC worker
+func (w *RateLimitGCWorker) Stop() {
+	close(w.stopCh)
+}
+
+// WSSessionGCWorker periodically evicts expired resumable WebSocket
+// sessions so wssession.Store's in-memory map and the ws_sessions table
+// don't grow without bound.
+type WSSessionGCWorker struct {
+	sessions *wssession.Store
+	interval time.Duration
+	stopCh   chan struct{}
+}
+
+// NewWSSessionGCWorker creates a new WebSocket session GC worker.
+func NewWSSessionGCWorker(sessions *wssession.Store, interval time.Duration) *WSSessionGCWorker {
+	return &WSSessionGCWorker{
+		sessions: sessions,
+		interval: interval,
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// Start starts the WebSocket session GC worker
+func (w *WSSessionGCWorker) Start(ctx context.Context) {
+	slog.Info("Starting WebSocket session GC worker", "interval", w.interval)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("WebSocket session GC worker stopped")
+			return
+		case <-w.stopCh:
+			slog.Info("WebSocket session GC worker stopped")
+			return
+		case <-ticker.C:
+			w.sessions.GC()
+		}
+	}
+}
+
+// Stop stops the WebSocket session GC worker
+func (w *WSSessionGCWorker) Stop() {
+	close(w.stopCh)
 }
@@ -0,0 +1,149 @@
+// Package wssession tracks resumable WebSocket sessions, borrowing the
+// Discord gateway's disconnect/resume model: a client that reconnects
+// within the session's TTL can replay what it missed per room instead of
+// the server falling back to a full undelivered_messages catch-up.
+package wssession
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Session is one resumable WebSocket session, spanning reconnects until it
+// goes stale (see Store's ttl) or the client abandons it for a fresh
+// connect.
+type Session struct {
+	SessionID string
+	TenantID  string
+	UserID    string
+	CreatedAt time.Time
+	lastSeen  time.Time
+}
+
+// Store tracks sessions in memory for fast resume against this process,
+// backed by the ws_sessions table so a session also survives this process
+// restarting within its TTL.
+type Store struct {
+	db  *sql.DB
+	ttl time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewStore creates a Store whose sessions are considered resumable for ttl
+// after their last activity.
+func NewStore(db *sql.DB, ttl time.Duration) *Store {
+	return &Store{db: db, ttl: ttl, sessions: make(map[string]*Session)}
+}
+
+// Create mints and persists a new session for tenantID/userID.
+func (s *Store) Create(tenantID, userID string) (*Session, error) {
+	now := time.Now()
+	sess := &Session{
+		SessionID: generateSessionID(),
+		TenantID:  tenantID,
+		UserID:    userID,
+		CreatedAt: now,
+		lastSeen:  now,
+	}
+
+	_, err := s.db.Exec(`
+		INSERT INTO ws_sessions (session_id, tenant_id, user_id, created_at, last_seen_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, sess.SessionID, tenantID, userID, sess.CreatedAt, sess.lastSeen)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.sessions[sess.SessionID] = sess
+	s.mu.Unlock()
+
+	return sess, nil
+}
+
+// Resume reports whether sessionID belongs to tenantID/userID and is still
+// within its TTL, refreshing its last-seen time if so. A caller that gets
+// ok == false must treat the resume as rejected (respond invalid_session)
+// rather than assume the session merely needs recreating.
+func (s *Store) Resume(tenantID, userID, sessionID string) (ok bool) {
+	s.mu.Lock()
+	sess, found := s.sessions[sessionID]
+	s.mu.Unlock()
+
+	if found {
+		if sess.TenantID != tenantID || sess.UserID != userID || time.Since(sess.lastSeen) > s.ttl {
+			return false
+		}
+		s.touch(sess)
+		return true
+	}
+
+	// Not held in memory - this process may have restarted since the
+	// session was created, so fall back to the durable table.
+	var lastSeenAt time.Time
+	err := s.db.QueryRow(`
+		SELECT last_seen_at FROM ws_sessions
+		WHERE session_id = ? AND tenant_id = ? AND user_id = ?
+	`, sessionID, tenantID, userID).Scan(&lastSeenAt)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		slog.Error("Failed to look up ws session", "session_id", sessionID, "error", err)
+		return false
+	}
+	if time.Since(lastSeenAt) > s.ttl {
+		return false
+	}
+
+	sess = &Session{SessionID: sessionID, TenantID: tenantID, UserID: userID, CreatedAt: lastSeenAt}
+	s.mu.Lock()
+	s.sessions[sessionID] = sess
+	s.mu.Unlock()
+	s.touch(sess)
+	return true
+}
+
+func (s *Store) touch(sess *Session) {
+	now := time.Now()
+	s.mu.Lock()
+	sess.lastSeen = now
+	s.mu.Unlock()
+
+	if _, err := s.db.Exec(`UPDATE ws_sessions SET last_seen_at = ? WHERE session_id = ?`, now, sess.SessionID); err != nil {
+		slog.Error("Failed to update ws session heartbeat", "session_id", sess.SessionID, "error", err)
+	}
+}
+
+// GC evicts sessions untouched for longer than the store's TTL, from memory
+// and from ws_sessions. Intended to be called periodically by
+// worker.WSSessionGCWorker.
+func (s *Store) GC() {
+	cutoff := time.Now().Add(-s.ttl)
+
+	s.mu.Lock()
+	for id, sess := range s.sessions {
+		if sess.lastSeen.Before(cutoff) {
+			delete(s.sessions, id)
+		}
+	}
+	s.mu.Unlock()
+
+	if _, err := s.db.Exec(`DELETE FROM ws_sessions WHERE last_seen_at < ?`, cutoff); err != nil {
+		slog.Error("Failed to prune stale ws sessions", "error", err)
+	}
+}
+
+func generateSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("failed to generate session id")
+	}
+	return hex.EncodeToString(b)
+}